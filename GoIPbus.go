@@ -37,10 +37,11 @@ package goipbus
 // Packages
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"github.com/tarm/serial"
+	"net/url"
 )
 
 // Implementation of IPbus protocol version 2.0
@@ -71,7 +72,7 @@ type IPbusPacketID uint16
 
 // Byte-order (4 bits)
 // 	0x0f big-endian
-//  0x00 endian-ness
+//  0x00 endian-ness, the words are in the native order of the sender
 type IPbusByteOrder uint8
 
 const Endian_ness IPbusByteOrder = 0x0
@@ -95,9 +96,6 @@ const (
 	// 0x3 – 0xf	n/a			Rsvd.
 )
 
-// Default, reliable traffic reliability mechanism is not required
-var packetID IPbusPacketID = 0
-
 // 3	IPbus Control Packet
 // An IPbus control packet is the concatenation of a control packet header
 // (Packet Type 0x0) and one or many IPbus transactions. Clearly when using a
@@ -110,7 +108,7 @@ var packetID IPbusPacketID = 0
 // In the following sub-sections the generic IPbus transaction header is described first, and then the individual transaction types are presented.
 type IPbusControlPacket struct {
 	ph   IPbusPacketHeader
-	reqs [3]IPbusRequest
+	reqs []IPbusRequest
 }
 
 // IPbusRequest structure for Encode/Decode
@@ -170,6 +168,27 @@ const (
 	OutboundRequest                         = 0x0f
 )
 
+// String returns the meaning of the Info Code as defined by the protocol
+func (code IPbusInfoCode) String() string {
+	switch code {
+	case RequestHandledSuccesfully:
+		return "request handled successfully"
+	case BadHeader:
+		return "bad header"
+	case BusErrorOnRead:
+		return "bus error on read"
+	case BusErrorOnWrite:
+		return "bus error on write"
+	case BusTimeOutOnRead:
+		return "bus timeout on read"
+	case BusTimeOutOnWrite:
+		return "bus timeout on write"
+	case OutboundRequest:
+		return "outbound request"
+	}
+	return fmt.Sprintf("reserved info code %#x", uint8(code))
+}
+
 // 3.1	IPbus Transaction Header
 // 31            28 ! 27		   16 ! 15           8 ! 7	   4 ! 3	0
 // Protocol Version	! Transaction ID  ! Words (8 bits) ! Type ID ! Info Code
@@ -225,16 +244,30 @@ const (
 type IPbusStatusPacket [16]int32
 
 //5	IPbus Re-send Packet
-//The re-send request packet is also a new addition of this protocol version and it is denoted by a Packet Type value of 0x3 in the packet header. This packet type is necessary for the reliability mechanism, and its purpose is to trigger a re-send of one of the target’s recent outbound control packets.  Like the status request, a re-send request packet must be big endian.
+//The re-send request packet is also a new addition of this protocol version and it is denoted by a Packet Type value of 0x2 in the packet header. This packet type is necessary for the reliability mechanism, and its purpose is to trigger a re-send of one of the target’s recent outbound control packets.  Like the status request, a re-send request packet must be big endian.
 type IPbusResendPacket int32
 
 //IPbusPacket
-//IPbusClient
-//IPbusTarget
 
-// All requests with non-zero ID received by a target must have consecutive ID values. Otherwise the packet header will be considered invalid and the packet will be silently dropped. A target will always accept control packets with ID value of 0.
-// The IPbus-level reliability mechanism only works with non-zero packet IDs. For simplicity a packet ID of 0x0 can be used for non-reliable traffic at any time. However it should be noted that the simultaneous use of both forms of IPbus traffic with a single target will disrupt the reliability mechanism.
-var transactionID IPbusTransactionID = 0
+// IPbusClient is the interface implemented by every IPbus transport.
+//
+// Dispatch encodes the control packet, sends it to the target and waits for
+// the reply with the same packet header. The decoded transaction responses are
+// returned in request order; the first response with an Info Code other than
+// RequestHandledSuccesfully is also reported as the returned error.
+//
+// Each client owns the Session holding the ID sequences of its target, so
+// several targets can be driven in parallel from the same process.
+type IPbusClient interface {
+	Dispatch(cp *IPbusControlPacket) (resps []IPbusResponse, err error)
+	// DispatchContext is Dispatch aborted when ctx is done, returning
+	// ctx.Err()
+	DispatchContext(ctx context.Context, cp *IPbusControlPacket) (resps []IPbusResponse, err error)
+	Session() *Session
+	Close() error
+}
+
+//IPbusTarget
 
 // Note that the maximum size of a standard Ethernet packet (without using jumbo
 // frames) is 1500 bytes; with an IP header of 20 bytes and a UDP header of 8 bytes,
@@ -243,12 +276,6 @@ var transactionID IPbusTransactionID = 0
 const maxWordSize uint16 = 368
 const maxByteSize uint16 = 1472
 
-// baseAddress store the address of the transaction
-var baseAddress BaseAddress = 0
-
-// transactionSize define the size of the transaction
-var transactionSize uint8 = 0
-
 // SectionReader implements Read, Seek, and ReadAt on a section
 // of an underlying ReaderAt.
 type SectionReader struct {
@@ -271,6 +298,9 @@ var EOF = errors.New("EOF")
 // middle of reading a fixed-size block or data structure.
 var ErrUnexpectedEOF = errors.New("unexpected EOF")
 
+// ErrShortBuffer means that a read or encode required a longer buffer than was provided.
+var ErrShortBuffer = errors.New("short buffer")
+
 // ErrNoProgress is returned by some clients of an io.Reader when
 // many calls to Read have failed to return any data or error,
 // usually the sign of a broken io.Reader implementation.
@@ -283,6 +313,50 @@ var errOffset = errors.New("Seek: invalid offset")
 //
 var errTypeNotSupported = errors.New("IPbus Type Id not supported")
 
+// ErrPacketFull is returned when a request does not fit in the control packet
+var ErrPacketFull = errors.New("IPbus control packet full")
+
+// ErrTimeout is returned when the target does not reply to a control packet in time.
+var ErrTimeout = errors.New("IPbus reply timeout")
+
+// URI errors
+var errSchemeNotSupported = errors.New("IPbus URI scheme not supported")
+var errReplyMismatch = errors.New("IPbus reply does not match the request")
+
+// Reply decoding errors, wrapped in a *DecodeError
+var ErrProtocolVersion = errors.New("IPbus protocol version not supported")
+var ErrByteOrder = errors.New("IPbus byte-order not supported")
+var ErrPacketType = errors.New("IPbus unexpected packet type")
+var ErrNotResponse = errors.New("IPbus transaction is a request, not a response")
+var ErrWordCount = errors.New("IPbus Words field inconsistent with the transaction type")
+
+// DecodeError reports a malformed reply packet, Offset is the byte offset of
+// the offending word within the packet.
+type DecodeError struct {
+	Offset int
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("IPbus decode error at byte %d: %v", e.Offset, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// InfoCodeError reports a transaction response whose Info Code is not
+// RequestHandledSuccesfully.
+type InfoCodeError struct {
+	ID       IPbusTransactionID
+	TypeID   IPbusTransactionTypeID
+	InfoCode IPbusInfoCode
+}
+
+func (e *InfoCodeError) Error() string {
+	return fmt.Sprintf("IPbus transaction %#x (type %#x): %v", e.ID, e.TypeID, e.InfoCode)
+}
+
 // Interfaces
 
 // Reader is the interface that wraps the basic Read method.
@@ -460,68 +534,78 @@ type LimitedReader struct {
 // --------------------------------------------------------
 // IPbus functions
 // --------------------------------------------------------
+// The ID sequences and defaults below live in a Session, callers must hold s.mu
+
 // Reset Packet for IPbus-level reliability mechanism
-func resetPacketID() error {
-	packetID = 0
+func (s *Session) resetPacketID() error {
+	s.packetID = 0
 	return nil
 }
 
 // Set Packet ID for Test Purpose
-func setPacketID(n IPbusPacketID) error {
-	packetID = n
+func (s *Session) setPacketID(n IPbusPacketID) error {
+	s.packetID = n
 	return nil
 }
 
-// Increase Packet ID sequence (16 bits) [0x0 , 0xffff]
-func increasePacketID() (id IPbusPacketID, err error) {
-	if packetID == 0xffff {
-		packetID = 0
+// Increase Packet ID sequence (16 bits) [0x1 , 0xffff]
+// Only reliable sessions count their packets, they never go back to 0x0,
+// reserved for non-reliable traffic. Non-reliable sessions keep their ID.
+func (s *Session) increasePacketID() (id IPbusPacketID, err error) {
+	if !s.reliable {
+		return s.packetID, nil
+	}
+	if s.packetID == 0xffff {
+		s.packetID = 0
+		if s.reliable {
+			s.packetID = 1
+		}
 	} else {
-		packetID++
+		s.packetID++
 	}
-	return packetID, nil
+	return s.packetID, nil
 }
 
 // Reset Transaction ID
-func resetTransactionID() error {
-	transactionID = 0
+func (s *Session) resetTransactionID() error {
+	s.transactionID = 0
 	return nil
 }
 
 // Set Transaction ID for Test Purpose
-func setTransactionID(id IPbusTransactionID) error {
-	transactionID = id
+func (s *Session) setTransactionID(id IPbusTransactionID) error {
+	s.transactionID = id
 	return nil
 }
 
 // Increase Transaction ID sequence (12 bits) [0x0 , 0x0fff]
-func increaseTransactionID() (id IPbusTransactionID, err error) {
-	if transactionID == 0x0fff {
-		transactionID = 0
+func (s *Session) increaseTransactionID() (id IPbusTransactionID, err error) {
+	if s.transactionID == 0x0fff {
+		s.transactionID = 0
 	} else {
-		transactionID++
+		s.transactionID++
 	}
-	return transactionID, nil
+	return s.transactionID, nil
 }
 
 // Set a default Base Address for Test Purposes
-func setBaseAddress(addr BaseAddress) error {
-	baseAddress = addr
+func (s *Session) setBaseAddress(addr BaseAddress) error {
+	s.baseAddress = addr
 	return nil
 }
 
 // Set the default transaction size Test Purposes
-func setTransactionSize(size uint8) error {
-	transactionSize = size
+func (s *Session) setTransactionSize(size uint8) error {
+	s.transactionSize = size
 	return nil
 }
 
 // Encode an IPbus packet header
-func encodePacketHeader(byteOrder IPbusByteOrder, packetType IPbusPacketType) (header IPbusPacketHeader, err error) {
+func (s *Session) encodePacketHeader(byteOrder IPbusByteOrder, packetType IPbusPacketType) (header IPbusPacketHeader, err error) {
 	var word uint32 = IPbusProtocolVersion << 28
 	word = word | ((uint32(byteOrder) << 4) | uint32(packetType))
-	word = word | uint32(packetID)<<8
-	_, err = increasePacketID()
+	word = word | uint32(s.packetID)<<8
+	_, err = s.increasePacketID()
 	if err != nil {
 		panic("Error generating Packet ID")
 	}
@@ -529,12 +613,12 @@ func encodePacketHeader(byteOrder IPbusByteOrder, packetType IPbusPacketType) (h
 }
 
 // Encode an IPbus transaction header
-func encodeTransactionHeader(transactionType IPbusTransactionTypeID, size uint8) (header IPbusTransactionHeader, err error) {
+func (s *Session) encodeTransactionHeader(transactionType IPbusTransactionTypeID, size uint8) (header IPbusTransactionHeader, err error) {
 	var word uint32 = IPbusProtocolVersion << 28
 	word = word | ((uint32(transactionType) << 4) | uint32(OutboundRequest))
 	word = word | (uint32(size) << 8)
-	word = word | uint32(transactionID)<<16
-	_, err = increaseTransactionID()
+	word = word | uint32(s.transactionID)<<16
+	_, err = s.increaseTransactionID()
 	if err != nil {
 		panic("Error generating Transaction ID")
 	}
@@ -542,40 +626,53 @@ func encodeTransactionHeader(transactionType IPbusTransactionTypeID, size uint8)
 }
 
 // Encode an IPbus Read Transaction Header (Type ID = 0x0)
-func encodeReadHeader(size uint8) (word0 IPbusTransactionHeader, err error) {
-	word0, err = encodeTransactionHeader(ReadTypeID, size)
+func (s *Session) encodeReadHeader(size uint8) (word0 IPbusTransactionHeader, err error) {
+	word0, err = s.encodeTransactionHeader(ReadTypeID, size)
 	return word0, err
 }
 
 // Encode an IPbus Write Transaction Header (Type ID = 0x1)
-func encodeWriteHeader(data []IPbusWord) (word0 IPbusTransactionHeader, err error) {
+func (s *Session) encodeWriteHeader(data []IPbusWord) (word0 IPbusTransactionHeader, err error) {
 	size := uint8(len(data))
-	word0, err = encodeTransactionHeader(WriteTypeID, size)
+	word0, err = s.encodeTransactionHeader(WriteTypeID, size)
 	return word0, err
 }
 
 // Encode an IPbus Non-incremental Read Transaction Header (Type ID = 0x2)
-func encodeNonIncrementalReadHeader(size uint8) (word0 IPbusTransactionHeader, err error) {
-	word0, err = encodeTransactionHeader(NonIncrementalReadTypeID, size)
+func (s *Session) encodeNonIncrementalReadHeader(size uint8) (word0 IPbusTransactionHeader, err error) {
+	word0, err = s.encodeTransactionHeader(NonIncrementalReadTypeID, size)
 	return word0, err
 }
 
 // Encode an IPbus Non-incremental Read Transaction Header (Type ID = 0x3)
-func encodeNonIncrementalWriteHeader(data []IPbusWord) (word0 IPbusTransactionHeader, err error) {
+func (s *Session) encodeNonIncrementalWriteHeader(data []IPbusWord) (word0 IPbusTransactionHeader, err error) {
 	size := uint8(len(data))
-	word0, err = encodeTransactionHeader(NonIncrementalWriteTypeID, size)
+	word0, err = s.encodeTransactionHeader(NonIncrementalWriteTypeID, size)
 	return word0, err
 }
 
 // Encode an IPbus RMWbits Transaction Header (Type ID = 0x4)
-func encodeRMWbitsHeader() (word0 IPbusTransactionHeader, err error) {
-	word0, err = encodeTransactionHeader(RMWbitsTypeID, 1)
+func (s *Session) encodeRMWbitsHeader() (word0 IPbusTransactionHeader, err error) {
+	word0, err = s.encodeTransactionHeader(RMWbitsTypeID, 1)
 	return word0, err
 }
 
 // Encode an IPbus RMWsum Transaction Header (Type ID = 0x5)
-func encodeRMWsumHeader() (word0 IPbusTransactionHeader, err error) {
-	word0, err = encodeTransactionHeader(RMWsumTypeID, 1)
+func (s *Session) encodeRMWsumHeader() (word0 IPbusTransactionHeader, err error) {
+	word0, err = s.encodeTransactionHeader(RMWsumTypeID, 1)
+	return word0, err
+}
+
+// Encode an IPbus Configuration Space Read Transaction Header (Type ID = 0x6)
+func (s *Session) encodeConfigurationSpaceReadHeader(size uint8) (word0 IPbusTransactionHeader, err error) {
+	word0, err = s.encodeTransactionHeader(ConfigurationSpaceRead, size)
+	return word0, err
+}
+
+// Encode an IPbus Configuration Space Write Transaction Header (Type ID = 0x7)
+func (s *Session) encodeConfigurationSpaceWriteHeader(data []IPbusWord) (word0 IPbusTransactionHeader, err error) {
+	size := uint8(len(data))
+	word0, err = s.encodeTransactionHeader(ConfigurationSpaceWrite, size)
 	return word0, err
 }
 
@@ -632,8 +729,11 @@ func transactionBufRequest(th IPbusTransactionHeader, addr BaseAddress, data []I
 // IPbus Control Packet with a single request, type:
 // 		ReadTypeID                 = 0x00 // 3.2	Read transaction (Type ID = 0x0)
 func readRequest(addr BaseAddress, size uint8) (b []byte, err error) {
-	ph, err := encodePacketHeader(BigEndian, ControlPacket)
-	word0, err := encodeReadHeader(size)
+	s := defaultSession
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ph, err := s.encodePacketHeader(BigEndian, ControlPacket)
+	word0, err := s.encodeReadHeader(size)
 	word1 := addr
 	b, err = packetBufRequest(ph, word0, word1, nil)
 	return b, err
@@ -642,8 +742,11 @@ func readRequest(addr BaseAddress, size uint8) (b []byte, err error) {
 // IPbus Control Packet with a single request, type:
 //		WriteTypeID                = 0x01 // 3.4	Write transaction (Type ID = 0x1)
 func writeRequest(addr BaseAddress, data []IPbusWord) (b []byte, err error) {
-	ph, err := encodePacketHeader(BigEndian, ControlPacket)
-	word0, err := encodeWriteHeader(data)
+	s := defaultSession
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ph, err := s.encodePacketHeader(BigEndian, ControlPacket)
+	word0, err := s.encodeWriteHeader(data)
 	word1 := addr
 	b, err = packetBufRequest(ph, word0, word1, data)
 	return b, err
@@ -652,8 +755,11 @@ func writeRequest(addr BaseAddress, data []IPbusWord) (b []byte, err error) {
 // IPbus Control Packet with a single request, type:
 // 		NonIncrementalReadTypeID   = 0x02 // 3.3	Non-incrementing read transaction (Type ID = 0x2))
 func NonIncrementalReadRequest(addr BaseAddress, size uint8) (b []byte, err error) {
-	ph, err := encodePacketHeader(BigEndian, ControlPacket)
-	word0, err := encodeNonIncrementalReadHeader(size)
+	s := defaultSession
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ph, err := s.encodePacketHeader(BigEndian, ControlPacket)
+	word0, err := s.encodeNonIncrementalReadHeader(size)
 	word1 := addr
 	b, err = packetBufRequest(ph, word0, word1, nil)
 	return b, err
@@ -662,8 +768,11 @@ func NonIncrementalReadRequest(addr BaseAddress, size uint8) (b []byte, err erro
 // IPbus Control Packet with a single request, type:
 // 		NonIncrementalWriteTypeID  = 0x03 // 3.5	Non-incrementing write transaction (Type ID = 0x3)
 func NonIncrementalWriteRequest(addr BaseAddress, data []IPbusWord) (b []byte, err error) {
-	ph, err := encodePacketHeader(BigEndian, ControlPacket)
-	word0, err := encodeNonIncrementalWriteHeader(data)
+	s := defaultSession
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ph, err := s.encodePacketHeader(BigEndian, ControlPacket)
+	word0, err := s.encodeNonIncrementalWriteHeader(data)
 	word1 := addr
 	b, err = packetBufRequest(ph, word0, word1, data)
 	return b, err
@@ -672,10 +781,13 @@ func NonIncrementalWriteRequest(addr BaseAddress, data []IPbusWord) (b []byte, e
 // IPbus Control Packet with a single request, type:
 // 		RMWbitsTypeID              = 0x04 // 3.6	Read/Modify/Write bits
 func RMWbitsRequest(addr BaseAddress, andTerm, orTerm IPbusWord) (b []byte, err error) {
-	ph, err := encodePacketHeader(BigEndian, ControlPacket)
-	word0, err := encodeRMWbitsHeader()
+	s := defaultSession
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ph, err := s.encodePacketHeader(BigEndian, ControlPacket)
+	word0, err := s.encodeRMWbitsHeader()
 	word1 := addr
-	data := make([]IPbusWord, 1)
+	data := make([]IPbusWord, 2)
 	data[0] = andTerm
 	data[1] = orTerm
 	b, err = packetBufRequest(ph, word0, word1, data)
@@ -685,8 +797,11 @@ func RMWbitsRequest(addr BaseAddress, andTerm, orTerm IPbusWord) (b []byte, err
 // IPbus Control Packet with a single request, type:
 // 		RMWsumTypeID               = 0x05 // 3.7	Read/Modify/Write sum (RMWsum) transaction (Type ID = 0x5)
 func RMWsumRequest(addr BaseAddress, addend IPbusWord) (b []byte, err error) {
-	ph, err := encodePacketHeader(BigEndian, ControlPacket)
-	word0, err := encodeRMWsumHeader()
+	s := defaultSession
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ph, err := s.encodePacketHeader(BigEndian, ControlPacket)
+	word0, err := s.encodeRMWsumHeader()
 	word1 := addr
 	data := make([]IPbusWord, 1)
 	data[0] = addend
@@ -703,7 +818,6 @@ func NewReadRequest(addr BaseAddress, size uint8) *IPbusRequest {
 	tr.infoCode = OutboundRequest
 	tr.addr = addr
 	tr.words = size
-	tr.id = transactionID
 
 	return tr
 }
@@ -786,22 +900,119 @@ func NewRMWsumRequest(addr BaseAddress, addend IPbusWord) *IPbusRequest {
 	return tr
 }
 
+//	New Configuration space read transaction (Type ID = 0x6)
+func NewConfigurationSpaceReadRequest(addr BaseAddress, size uint8) *IPbusRequest {
+	// construct transaction request
+	tr := new(IPbusRequest)
+	// Set provided transaction fields
+	tr.typeId = ConfigurationSpaceRead
+	tr.infoCode = OutboundRequest
+	tr.addr = addr
+	tr.words = size
+
+	return tr
+}
+
+//	New Configuration space write transaction (Type ID = 0x7)
+func NewConfigurationSpaceWriteRequest(addr BaseAddress, data []IPbusWord) *IPbusRequest {
+	// construct transaction request
+	tr := new(IPbusRequest)
+	// Set provided transaction fields
+	tr.typeId = ConfigurationSpaceWrite
+	tr.infoCode = OutboundRequest
+	tr.addr = addr
+	tr.words = uint8(len(data))
+	tr.data = data
+
+	return tr
+}
+
 // -----------------------------------------------------------------------------
 // IPbus Control Packet Methods
 // -----------------------------------------------------------------------------
 
-// IPbus Control Packet Encode
+// Append adds a transaction request to the control packet. The request is
+// refused with ErrPacketFull if either the request or the expected response
+// packet would exceed maxByteSize. Requests carrying more than 255 words are
+// refused with ErrTransactionSize, see NewBlockWriteRequests.
+func (cp *IPbusControlPacket) Append(tr *IPbusRequest) error {
+	if len(tr.data) > maxTransactionWords {
+		return ErrTransactionSize
+	}
+	if cp.RequestSize()+tr.RequestSize() > int(maxByteSize) ||
+		cp.ResponseSize()+tr.ResponseSize() > int(maxByteSize) {
+		return ErrPacketFull
+	}
+	cp.reqs = append(cp.reqs, *tr)
+	return nil
+}
+
+// Len returns the number of transaction requests in the control packet
+func (cp *IPbusControlPacket) Len() int {
+	return len(cp.reqs)
+}
+
+// RequestSize returns the encoded size in bytes of the control packet
+func (cp *IPbusControlPacket) RequestSize() int {
+	n := 4
+	for i := range cp.reqs {
+		n += cp.reqs[i].RequestSize()
+	}
+	return n
+}
+
+// ResponseSize returns the size in bytes of the expected reply packet
+func (cp *IPbusControlPacket) ResponseSize() int {
+	n := 4
+	for i := range cp.reqs {
+		n += cp.reqs[i].ResponseSize()
+	}
+	return n
+}
+
+// PackRequests spreads the transaction requests, in order, over as many
+// control packets as required to keep every request and response within
+// maxByteSize.
+func PackRequests(reqs []*IPbusRequest) (cps []*IPbusControlPacket, err error) {
+	cp := new(IPbusControlPacket)
+	for _, tr := range reqs {
+		err = cp.Append(tr)
+		if err == ErrPacketFull && cp.Len() > 0 {
+			cps = append(cps, cp)
+			cp = new(IPbusControlPacket)
+			err = cp.Append(tr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cp.Len() > 0 {
+		cps = append(cps, cp)
+	}
+	return cps, nil
+}
+
+// IPbus Control Packet Encode, IDs are taken from the package default session
 func (cp *IPbusControlPacket) Encode(b []byte) (n int, err error) {
+	return defaultSession.Encode(cp, b)
+}
+
+// Encode the control packet with IDs from session s, callers must hold s.mu
+func (cp *IPbusControlPacket) encode(s *Session, b []byte) (n int, err error) {
+	if len(b) < cp.RequestSize() {
+		return 0, ErrShortBuffer
+	}
 	buf := new(bytes.Buffer)
-	ph, err := encodePacketHeader(BigEndian, ControlPacket)
+	ph, err := s.encodePacketHeader(s.byteOrder(), ControlPacket)
 	err = binary.Write(buf, binary.BigEndian, ph)
 	if err != nil {
 		panic("Error generating request buffer")
 	}
 	cp.ph = ph
 
-	for _, v := range cp.reqs {
-		_, err := v.Encode()
+	for i := range cp.reqs {
+		v := &cp.reqs[i]
+		_, err := v.encode(s)
 		if err != nil {
 			panic("Error generating request buffer")
 		}
@@ -809,6 +1020,9 @@ func (cp *IPbusControlPacket) Encode(b []byte) (n int, err error) {
 	}
 
 	n = copy(b, buf.Bytes())
+	if s.native && hostByteOrder == binary.LittleEndian {
+		swapWords(b[:n])
+	}
 	return n, err
 }
 
@@ -816,6 +1030,24 @@ func (cp *IPbusControlPacket) Encode(b []byte) (n int, err error) {
 // IPbus Request Methods
 // -----------------------------------------------------------------------------
 
+// RequestSize returns the encoded size in bytes of the transaction request
+func (tr *IPbusRequest) RequestSize() int {
+	switch tr.typeId {
+	case WriteTypeID, NonIncrementalWriteTypeID, ConfigurationSpaceWrite:
+		return 4 * (2 + len(tr.data))
+	case RMWbitsTypeID:
+		return 16
+	case RMWsumTypeID:
+		return 12
+	}
+	return 8
+}
+
+// ResponseSize returns the size in bytes of the successful transaction response
+func (tr *IPbusRequest) ResponseSize() int {
+	return 4 * (1 + responsePayloadSize(tr.words, tr.typeId, RequestHandledSuccesfully))
+}
+
 // Encode a byte array containing an IPbus packet
 // Required request information is defined in IPbusRequest structure. Supported transactions request are:
 // 		ReadTypeID                 = 0x00 // 3.2	Read transaction (Type ID = 0x0)
@@ -826,47 +1058,68 @@ func (cp *IPbusControlPacket) Encode(b []byte) (n int, err error) {
 // 		RMWsumTypeID               = 0x05 // 3.7	Read/Modify/Write sum (RMWsum) transaction (Type ID = 0x5)
 // 		ConfigurationSpaceRead     = 0x06 // 3.8	Configuration space read transaction (Type ID = 0x6)
 // 		ConfigurationSpaceWrite    = 0x07 // 3.9	Configuration space write transaction (Type ID = 0x7)
+// Transaction IDs are taken from the package default session.
 //func (tr *IPbusRequest) Encode(b []byte) (n int, err error) {
 func (tr *IPbusRequest) Encode() (n int, err error) {
+	s := defaultSession
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return tr.encode(s)
+}
+
+// Encode the request with the next transaction ID of session s, callers must hold s.mu
+func (tr *IPbusRequest) encode(s *Session) (n int, err error) {
 	// set header and Transaction ID
-	tr.id = transactionID
+	tr.id = s.transactionID
 
 	// build headers
 	switch tr.typeId {
 	// Select header builder
 	case ReadTypeID:
-		h, err := encodeReadHeader(tr.words)
+		h, err := s.encodeReadHeader(tr.words)
 		if err != nil {
 			panic("Error generating header")
 		}
 		tr.th = h
 	case WriteTypeID:
-		h, err := encodeWriteHeader(tr.data)
+		h, err := s.encodeWriteHeader(tr.data)
 		if err != nil {
 			panic("Error generating header")
 		}
 		tr.th = h
 	case NonIncrementalReadTypeID:
-		h, err := encodeNonIncrementalReadHeader(tr.words)
+		h, err := s.encodeNonIncrementalReadHeader(tr.words)
 		if err != nil {
 			panic("Error generating header")
 		}
 		tr.th = h
 	case NonIncrementalWriteTypeID:
-		h, err := encodeNonIncrementalWriteHeader(tr.data)
+		h, err := s.encodeNonIncrementalWriteHeader(tr.data)
 		if err != nil {
 			panic("Error generating header")
 		}
 		tr.th = h
 	case RMWbitsTypeID:
-		h, err := encodeRMWbitsHeader()
+		h, err := s.encodeRMWbitsHeader()
 		if err != nil {
 			panic("Error generating header")
 		}
 		tr.th = h
 	case RMWsumTypeID:
 		// Header
-		h, err := encodeRMWsumHeader()
+		h, err := s.encodeRMWsumHeader()
+		if err != nil {
+			panic("Error generating header")
+		}
+		tr.th = h
+	case ConfigurationSpaceRead:
+		h, err := s.encodeConfigurationSpaceReadHeader(tr.words)
+		if err != nil {
+			panic("Error generating header")
+		}
+		tr.th = h
+	case ConfigurationSpaceWrite:
+		h, err := s.encodeConfigurationSpaceWriteHeader(tr.data)
 		if err != nil {
 			panic("Error generating header")
 		}
@@ -883,12 +1136,16 @@ func (tr *IPbusRequest) Encode() (n int, err error) {
 	if err != nil {
 		panic("Error generating request buffer")
 	}
-	for _, v := range tr.data {
-		err = binary.Write(buf, binary.BigEndian, v)
-		if err != nil {
-			panic("Error generating request buffer")
+	// Reads carry no data words, whatever is left in tr.data
+	switch tr.typeId {
+	case ReadTypeID, NonIncrementalReadTypeID, ConfigurationSpaceRead:
+	default:
+		for _, v := range tr.data {
+			err = binary.Write(buf, binary.BigEndian, v)
+			if err != nil {
+				panic("Error generating request buffer")
+			}
 		}
-		fmt.Printf("write %#x\n", v)
 	}
 
 	// Copy buffer content into the request byte array
@@ -1108,38 +1365,177 @@ func (tr *IPbusRequest) RMWsum(p []byte) (n int, err error) {
 // -----------------------------------------------------------------------------
 // Response methods
 // -----------------------------------------------------------------------------
-func (resp *IPbusResponse) Decode(dst IPbusRequest) (err error) {
 
-	buf := new(bytes.Buffer)
-	err = binary.Write(buf, binary.BigEndian, resp.b)
-	if err != nil {
-		panic("Error generating request buffer")
+// Number of payload words following a response transaction header. Error
+// responses carry no payload.
+func responsePayloadSize(words uint8, typeId IPbusTransactionTypeID, infoCode IPbusInfoCode) int {
+	if infoCode != RequestHandledSuccesfully {
+		return 0
+	}
+	switch typeId {
+	case ReadTypeID, NonIncrementalReadTypeID, ConfigurationSpaceRead:
+		return int(words)
+	case RMWbitsTypeID, RMWsumTypeID:
+		return 1
 	}
+	return 0
+}
 
-	//	size := buf.Len() / 4
-	var r []uint32
+// Packet header fields
+func (ph IPbusPacketHeader) Version() uint8 {
+	return uint8(uint32(ph) >> 28)
+}
 
-	err = binary.Read(buf, binary.BigEndian, &r)
-	if err != nil {
-		panic("Error generating request buffer")
+func (ph IPbusPacketHeader) ID() IPbusPacketID {
+	return IPbusPacketID(uint32(ph) >> 8)
+}
+
+func (ph IPbusPacketHeader) ByteOrder() IPbusByteOrder {
+	return IPbusByteOrder((uint32(ph) >> 4) & 0xf)
+}
+
+func (ph IPbusPacketHeader) Type() IPbusPacketType {
+	return IPbusPacketType(uint32(ph) & 0xf)
+}
+
+// DecodeControlPacket decodes a control packet reply into its packet header
+// and the transaction responses it contains. The byte order of the words is
+// detected from the packet header, either qualifier is accepted. Malformed
+// replies are reported as a *DecodeError.
+func DecodeControlPacket(b []byte) (ph IPbusPacketHeader, resps []IPbusResponse, err error) {
+	if len(b) < 4 {
+		return 0, nil, &DecodeError{Offset: 0, Err: ErrUnexpectedEOF}
+	}
+	if packetSwapped(b) {
+		b = append([]byte(nil), b...)
+		swapWords(b)
+	}
+	ph = IPbusPacketHeader(binary.BigEndian.Uint32(b))
+	switch {
+	case ph.Version() != IPbusProtocolVersion:
+		return ph, nil, &DecodeError{Offset: 0, Err: ErrProtocolVersion}
+	case ph.ByteOrder() != BigEndian && ph.ByteOrder() != NativeEndian:
+		return ph, nil, &DecodeError{Offset: 0, Err: ErrByteOrder}
+	case ph.Type() != ControlPacket:
+		return ph, nil, &DecodeError{Offset: 0, Err: ErrPacketType}
 	}
-	word := r[0]
+
+	for off := 4; off < len(b); {
+		var resp IPbusResponse
+		n, err := resp.Decode(b[off:])
+		if err != nil {
+			if de, ok := err.(*DecodeError); ok {
+				de.Offset += off
+			}
+			return ph, resps, err
+		}
+		resps = append(resps, resp)
+		off += n
+	}
+	return ph, resps, nil
+}
+
+// Check that the responses answer the requests of the control packet in order
+// and report the first transaction error. Successful responses must carry the
+// payload of the request, a read answered with fewer words is ErrWordCount.
+func (cp *IPbusControlPacket) checkReply(resps []IPbusResponse) error {
+	if len(resps) != len(cp.reqs) {
+		return errReplyMismatch
+	}
+	for i := range resps {
+		if resps[i].id != cp.reqs[i].id || resps[i].typeId != cp.reqs[i].typeId {
+			return errReplyMismatch
+		}
+	}
+	for i := range resps {
+		rq := &cp.reqs[i]
+		if resps[i].infoCode == RequestHandledSuccesfully &&
+			len(resps[i].data) != responsePayloadSize(rq.words, rq.typeId, RequestHandledSuccesfully) {
+			return ErrWordCount
+		}
+	}
+	for i := range resps {
+		if err := resps[i].Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Response fields
+func (resp *IPbusResponse) ID() IPbusTransactionID {
+	return resp.id
+}
+
+func (resp *IPbusResponse) Words() uint8 {
+	return resp.words
+}
+
+func (resp *IPbusResponse) TypeID() IPbusTransactionTypeID {
+	return resp.typeId
+}
+
+func (resp *IPbusResponse) InfoCode() IPbusInfoCode {
+	return resp.infoCode
+}
+
+// Data returns the words read by the transaction
+func (resp *IPbusResponse) Data() []IPbusWord {
+	return resp.data
+}
+
+// Err returns an *InfoCodeError if the transaction was not handled successfully
+func (resp *IPbusResponse) Err() error {
+	if resp.infoCode == RequestHandledSuccesfully {
+		return nil
+	}
+	return &InfoCodeError{ID: resp.id, TypeID: resp.typeId, InfoCode: resp.infoCode}
+}
+
+// Decode a single big-endian transaction response from the head of b.
+// It returns the number of bytes consumed; the payload length is checked
+// against the Words field for every transaction type.
+func (resp *IPbusResponse) Decode(b []byte) (n int, err error) {
+	if len(b) < 4 {
+		return 0, &DecodeError{Offset: 0, Err: ErrUnexpectedEOF}
+	}
+	word := binary.BigEndian.Uint32(b)
 	protocol := (0xF0000000 & word) >> 28
-	id := (0x0FF00000 & word) >> 16
-	words := (0x0000FF00 & word) >> 8
-	typeId := (0x000000F0 & word)
-	infoCode := (0x0000000F & word)
+	resp.id = IPbusTransactionID((0x0FFF0000 & word) >> 16)
+	resp.words = uint8((0x0000FF00 & word) >> 8)
+	resp.typeId = IPbusTransactionTypeID((0x000000F0 & word) >> 4)
+	resp.infoCode = IPbusInfoCode(0x0000000F & word)
 
-	if protocol != 0x2 {
-		panic("Protocol Error")
+	if protocol != IPbusProtocolVersion {
+		return 0, &DecodeError{Offset: 0, Err: ErrProtocolVersion}
+	}
+	if resp.infoCode == OutboundRequest {
+		return 0, &DecodeError{Offset: 0, Err: ErrNotResponse}
+	}
+	switch resp.typeId {
+	case ReadTypeID, NonIncrementalReadTypeID, WriteTypeID, NonIncrementalWriteTypeID,
+		ConfigurationSpaceRead, ConfigurationSpaceWrite:
+	case RMWbitsTypeID, RMWsumTypeID:
+		if resp.words != 1 {
+			return 0, &DecodeError{Offset: 0, Err: ErrWordCount}
+		}
+	default:
+		return 0, &DecodeError{Offset: 0, Err: errTypeNotSupported}
 	}
 
-	dst.id = IPbusTransactionID(id)
-	dst.words = uint8(words)
-	dst.typeId = IPbusTransactionTypeID(typeId)
-	dst.infoCode = IPbusInfoCode(infoCode)
+	size := responsePayloadSize(resp.words, resp.typeId, resp.infoCode)
+	n = 4 * (1 + size)
+	if len(b) < n {
+		return 0, &DecodeError{Offset: len(b) &^ 3, Err: ErrUnexpectedEOF}
+	}
+	resp.data = make([]IPbusWord, size)
+	for i := range resp.data {
+		resp.data[i] = IPbusWord(binary.BigEndian.Uint32(b[4*(i+1):]))
+	}
+	resp.b = b[:n]
+	resp.payload = IPbusPayload{words: uint8(size), data: resp.data}
 
-	return err
+	return n, nil
 }
 
 //
@@ -1148,7 +1544,9 @@ func (resp *IPbusResponse) Decode(dst IPbusRequest) (err error) {
 
 func Read(p []byte) (n int, err error) {
 	n0 := uint8(n)
-	word0, err := encodeTransactionHeader(ReadTypeID, n0)
+	defaultSession.mu.Lock()
+	word0, err := defaultSession.encodeTransactionHeader(ReadTypeID, n0)
+	defaultSession.mu.Unlock()
 	fmt.Println(word0)
 	n1 := 0
 	return n1, err
@@ -1160,7 +1558,9 @@ func Read(p []byte) (n int, err error) {
 
 func Write(p []byte) (n int, err error) {
 	n0 := uint8(n)
-	word0, err := encodeTransactionHeader(ReadTypeID, n0)
+	defaultSession.mu.Lock()
+	word0, err := defaultSession.encodeTransactionHeader(ReadTypeID, n0)
+	defaultSession.mu.Unlock()
 	fmt.Println(word0)
 	n1 := 0
 	return n1, err
@@ -1174,4 +1574,31 @@ func Write(p []byte) (n int, err error) {
 
 //}
 
-func Open
\ No newline at end of file
+// Open connects to the IPbus target identified by uri, selecting the transport
+// from the URI scheme, e.g. ipbusudp-2.0://localhost:50001 or
+// chtcp-2.0://localhost:10203?target=localhost:50001
+func Open(uri string) (IPbusClient, error) {
+	scheme, host, err := splitURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case UDPScheme:
+		return DialUDP(host)
+	case TCPScheme:
+		return DialTCP(host)
+	case ControlHubScheme:
+		return DialControlHub(uri)
+	}
+	return nil, errSchemeNotSupported
+}
+
+// Split an IPbus URI into its scheme and host:port parts. A bare host:port is
+// returned with an empty scheme.
+func splitURI(uri string) (scheme, host string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return "", uri, nil
+	}
+	return u.Scheme, u.Host, nil
+}
@@ -0,0 +1,421 @@
+// GoIPbus uHAL address tables
+
+package goipbus
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Permission of an address table node
+type Permission uint8
+
+const (
+	PermissionRead      Permission = 0x1
+	PermissionWrite     Permission = 0x2
+	PermissionReadWrite Permission = PermissionRead | PermissionWrite
+)
+
+func (p Permission) String() string {
+	switch p {
+	case PermissionRead:
+		return "r"
+	case PermissionWrite:
+		return "w"
+	case PermissionReadWrite:
+		return "rw"
+	}
+	return fmt.Sprintf("permission %#x", uint8(p))
+}
+
+// Mode of an address table node
+type Mode uint8
+
+const (
+	// A single register
+	ModeSingle Mode = iota
+	// A block of Size words at consecutive addresses
+	ModeIncremental
+	// A port or FIFO reading or writing Size words at the same address
+	ModeNonIncremental
+	// A node grouping its children
+	ModeHierarchical
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeSingle:
+		return "single"
+	case ModeIncremental:
+		return "incremental"
+	case ModeNonIncremental:
+		return "non-incremental"
+	case ModeHierarchical:
+		return "hierarchical"
+	}
+	return fmt.Sprintf("mode %#x", uint8(m))
+}
+
+// Address table errors
+var ErrNodeNotFound = errors.New("IPbus address table node not found")
+var ErrNodeAttribute = errors.New("IPbus address table invalid attribute")
+var ErrDuplicateNode = errors.New("IPbus address table duplicate node id")
+var ErrModuleCycle = errors.New("IPbus address table module includes itself")
+
+// NodeError records the address table node an error refers to
+type NodeError struct {
+	Path string
+	Err  error
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("%v: %q", e.Err, e.Path)
+}
+
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
+
+// Node is an entry of a uHAL address table. Addresses are resolved to the
+// absolute address on the bus: the address attribute of every node is
+// relative to its parent.
+type Node struct {
+	id          string
+	path        string
+	address     BaseAddress
+	mask        IPbusWord
+	permission  Permission
+	mode        Mode
+	size        int
+	tags        string
+	description string
+	children    []*Node
+	byID        map[string]*Node
+}
+
+// ID returns the id attribute of the node
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Path returns the dotted ids leading to the node from the top of the table
+func (n *Node) Path() string {
+	return n.path
+}
+
+// Address returns the absolute address of the node
+func (n *Node) Address() BaseAddress {
+	return n.address
+}
+
+// Mask returns the bits of the register covered by the node, 0xffffffff by default
+func (n *Node) Mask() IPbusWord {
+	return n.mask
+}
+
+// Permission returns whether the node can be read and/or written
+func (n *Node) Permission() Permission {
+	return n.permission
+}
+
+// Mode returns how the words of the node are addressed
+func (n *Node) Mode() Mode {
+	return n.mode
+}
+
+// Size returns the number of words of a block or port node, 1 otherwise
+func (n *Node) Size() int {
+	return n.size
+}
+
+// Tags returns the tags attribute of the node
+func (n *Node) Tags() string {
+	return n.tags
+}
+
+// Description returns the description attribute of the node
+func (n *Node) Description() string {
+	return n.description
+}
+
+// Children returns the child nodes in the order of the table
+func (n *Node) Children() []*Node {
+	return n.children
+}
+
+// GetNode returns the descendant of n with the dotted path "A.B.C", the
+// empty path is n itself
+func (n *Node) GetNode(path string) (*Node, error) {
+	node := n
+	if path == "" {
+		return node, nil
+	}
+	for _, id := range strings.Split(path, ".") {
+		child, ok := node.byID[id]
+		if !ok {
+			return nil, &NodeError{Path: joinPath(n.path, path), Err: ErrNodeNotFound}
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// GetNodes returns the paths of all the descendants of n, relative to n, in
+// the order of the table
+func (n *Node) GetNodes() (paths []string) {
+	for _, c := range n.children {
+		paths = append(paths, c.id)
+		for _, p := range c.GetNodes() {
+			paths = append(paths, c.id+"."+p)
+		}
+	}
+	return paths
+}
+
+func joinPath(parent, id string) string {
+	if parent == "" {
+		return id
+	}
+	return parent + "." + id
+}
+
+// XML representation of a node
+type xmlNode struct {
+	ID          string    `xml:"id,attr"`
+	Address     string    `xml:"address,attr"`
+	Mask        string    `xml:"mask,attr"`
+	Permission  string    `xml:"permission,attr"`
+	Mode        string    `xml:"mode,attr"`
+	Size        string    `xml:"size,attr"`
+	Tags        string    `xml:"tags,attr"`
+	Description string    `xml:"description,attr"`
+	Module      string    `xml:"module,attr"`
+	Nodes       []xmlNode `xml:"node"`
+}
+
+// LoadAddressTable reads the uHAL address table in file name. Module
+// includes, module="file://sub.xml", are resolved relative to the directory
+// of the including file.
+func LoadAddressTable(name string) (*Node, error) {
+	return loadAddressTable(name, nil)
+}
+
+// ParseAddressTable reads a uHAL address table from r, modules are resolved
+// relative to dir
+func ParseAddressTable(r io.Reader, dir string) (*Node, error) {
+	x, err := decodeAddressTable(r)
+	if err != nil {
+		return nil, err
+	}
+	return buildNode(x, "", 0, dir, nil)
+}
+
+func loadAddressTable(name string, includes []string) (*Node, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, inc := range includes {
+		if inc == abs {
+			return nil, &NodeError{Path: name, Err: ErrModuleCycle}
+		}
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	x, err := decodeAddressTable(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	return buildNode(x, "", 0, filepath.Dir(name), append(includes, abs))
+}
+
+func decodeAddressTable(r io.Reader) (*xmlNode, error) {
+	d := xml.NewDecoder(r)
+	d.CharsetReader = charsetReader
+	x := new(xmlNode)
+	err := d.Decode(x)
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// The address tables of the CTP6 are declared ISO-8859-1
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1":
+		return &latin1Reader{r: bufio.NewReader(input)}, nil
+	}
+	return nil, fmt.Errorf("unsupported charset %q", charset)
+}
+
+// Convert ISO-8859-1 bytes into UTF-8
+type latin1Reader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func (l *latin1Reader) Read(p []byte) (n int, err error) {
+	for len(l.buf) == 0 {
+		c, err := l.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c < 0x80 {
+			l.buf = append(l.buf, c)
+		} else {
+			l.buf = append(l.buf, 0xc0|c>>6, 0x80|c&0x3f)
+		}
+	}
+	n = copy(p, l.buf)
+	l.buf = l.buf[n:]
+	return n, nil
+}
+
+// Parse a 32-bit attribute value, decimal or 0x-prefixed hexadecimal
+func parseWord(path, attr, def string) (uint32, error) {
+	if attr == "" {
+		attr = def
+	}
+	v, err := strconv.ParseUint(attr, 0, 32)
+	if err != nil {
+		return 0, &NodeError{Path: path, Err: ErrNodeAttribute}
+	}
+	return uint32(v), nil
+}
+
+// Resolve a node of the table and its children. base is the absolute address
+// of the parent.
+func buildNode(x *xmlNode, parent string, base BaseAddress, dir string, includes []string) (*Node, error) {
+	if strings.Contains(x.ID, ".") {
+		return nil, &NodeError{Path: joinPath(parent, x.ID), Err: ErrNodeAttribute}
+	}
+	path := parent
+	if x.ID != "" {
+		path = joinPath(parent, x.ID)
+	}
+	n := &Node{id: x.ID, path: path, tags: x.Tags, description: x.Description, size: 1}
+
+	addr, err := parseWord(path, x.Address, "0")
+	if err != nil {
+		return nil, err
+	}
+	n.address = base + BaseAddress(addr)
+	mask, err := parseWord(path, x.Mask, "0xffffffff")
+	if err != nil {
+		return nil, err
+	}
+	n.mask = IPbusWord(mask)
+
+	switch strings.ToLower(x.Permission) {
+	case "", "rw", "wr", "readwrite", "read-write":
+		n.permission = PermissionReadWrite
+	case "r", "read":
+		n.permission = PermissionRead
+	case "w", "write":
+		n.permission = PermissionWrite
+	default:
+		return nil, &NodeError{Path: path, Err: ErrNodeAttribute}
+	}
+
+	switch strings.ToLower(x.Mode) {
+	case "", "single":
+		n.mode = ModeSingle
+	case "incremental", "inc", "block":
+		n.mode = ModeIncremental
+	case "non-incremental", "nonincremental", "non-inc", "port":
+		n.mode = ModeNonIncremental
+	case "hierarchical":
+		n.mode = ModeHierarchical
+	default:
+		return nil, &NodeError{Path: path, Err: ErrNodeAttribute}
+	}
+	if x.Size != "" {
+		size, err := parseWord(path, x.Size, "1")
+		if err != nil {
+			return nil, err
+		}
+		n.size = int(size)
+	}
+
+	nodes := x.Nodes
+	if x.Module != "" {
+		// The top node of the module takes the place of this node
+		name := strings.TrimPrefix(x.Module, "file://")
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		m, err := loadAddressTable(name, includes)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range m.children {
+			rc, err := rebase(c, path, n.address)
+			if err != nil {
+				return nil, err
+			}
+			if err := n.addChild(rc); err != nil {
+				return nil, err
+			}
+		}
+		nodes = nil
+	}
+	for i := range nodes {
+		c, err := buildNode(&nodes[i], path, n.address, dir, includes)
+		if err != nil {
+			return nil, err
+		}
+		if err := n.addChild(c); err != nil {
+			return nil, err
+		}
+	}
+	if len(n.children) > 0 {
+		n.mode = ModeHierarchical
+	}
+	return n, nil
+}
+
+// Move a node loaded from a module under the path and base address of the
+// including node
+func rebase(n *Node, parent string, base BaseAddress) (*Node, error) {
+	c := *n
+	c.path = joinPath(parent, n.id)
+	c.address = base + n.address
+	c.children = nil
+	c.byID = nil
+	for _, child := range n.children {
+		rc, err := rebase(child, c.path, base)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.addChild(rc); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+func (n *Node) addChild(c *Node) error {
+	if n.byID == nil {
+		n.byID = make(map[string]*Node)
+	}
+	if c.id == "" {
+		return &NodeError{Path: joinPath(n.path, "?"), Err: ErrNodeAttribute}
+	}
+	if _, ok := n.byID[c.id]; ok {
+		return &NodeError{Path: c.path, Err: ErrDuplicateNode}
+	}
+	n.byID[c.id] = c
+	n.children = append(n.children, c)
+	return nil
+}
@@ -0,0 +1,119 @@
+package goipbus
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoadAddressTable(t *testing.T) {
+	top, err := LoadAddressTable("cactuscore/softipbus/etc/test_address.xml")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	expected := []struct {
+		path       string
+		address    BaseAddress
+		mask       uint32
+		permission Permission
+		mode       Mode
+		size       int
+	}{
+		{"REG", 0x1, 0xffffffff, PermissionReadWrite, ModeSingle, 1},
+		{"REG_READ_ONLY", 0x2, 0xffffffff, PermissionRead, ModeSingle, 1},
+		{"REG_WRITE_ONLY", 0x3, 0xffffffff, PermissionWrite, ModeSingle, 1},
+		{"REG_UPPER_MASK", 0x4, 0xffff0000, PermissionReadWrite, ModeSingle, 1},
+		{"FIFO", 0x100, 0xffffffff, PermissionReadWrite, ModeNonIncremental, 262144},
+		{"MEM", 0x200, 0xffffffff, PermissionReadWrite, ModeIncremental, 262144},
+	}
+	for _, e := range expected {
+		n, err := top.GetNode(e.path)
+		if err != nil {
+			t.Fatalf("Error %v\n", err)
+		}
+		if n.Address() != e.address || uint32(n.Mask()) != e.mask || n.Permission() != e.permission ||
+			n.Mode() != e.mode || n.Size() != e.size {
+			t.Errorf("Expected %v %#x %#x %v %v %v, generated %#x %#x %v %v %v\n", e.path,
+				e.address, e.mask, e.permission, e.mode, e.size,
+				n.Address(), n.Mask(), n.Permission(), n.Mode(), n.Size())
+		}
+	}
+	if n, _ := top.GetNode("REG"); n.Tags() != "test" {
+		t.Errorf("Expected tags test, generated %q\n", n.Tags())
+	}
+	if len(top.GetNodes()) != 7 {
+		t.Errorf("Expected 7 nodes, generated %v\n", top.GetNodes())
+	}
+}
+
+func TestAddressTableHierarchy(t *testing.T) {
+	top, err := LoadAddressTable("testdata/nested_address.xml")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	n, err := top.GetNode("CTRL.LINK.ENABLE")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if n.Address() != 0x1012 || n.Mask() != 0xff0 || n.Path() != "CTRL.LINK.ENABLE" {
+		t.Errorf("Expected CTRL.LINK.ENABLE at 0x1012, generated %v at %#x\n", n.Path(), n.Address())
+	}
+	ctrl, _ := top.GetNode("CTRL")
+	if ctrl.Mode() != ModeHierarchical || len(ctrl.Children()) != 3 {
+		t.Errorf("Expected hierarchical node with 3 children, generated %v %v\n", ctrl.Mode(), len(ctrl.Children()))
+	}
+	if n, err := ctrl.GetNode("LINK.ENABLE"); err != nil || n.Address() != 0x1012 {
+		t.Errorf("Expected relative lookup of LINK.ENABLE, generated %v\n", err)
+	}
+
+	// Nodes of the module are relative to the including node
+	n, err = top.GetNode("TEST.MEM")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if n.Address() != 0x2200 || n.Mode() != ModeIncremental || n.Path() != "TEST.MEM" {
+		t.Errorf("Expected TEST.MEM at 0x2200, generated %v at %#x\n", n.Path(), n.Address())
+	}
+
+	_, err = top.GetNode("CTRL.MISSING")
+	var ne *NodeError
+	if !errors.As(err, &ne) || ne.Err != ErrNodeNotFound || ne.Path != "CTRL.MISSING" {
+		t.Errorf("Expected %v, generated %v\n", ErrNodeNotFound, err)
+	}
+}
+
+func TestLoadCTP6AddressTable(t *testing.T) {
+	top, err := LoadAddressTable("cactuscore/softipbus/etc/ctp6_fe.xml")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	n, err := top.GetNode("MGT0")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if n.Address() != 0x60000000 || n.Size() != 1024 || n.Mode() != ModeIncremental || n.Permission() != PermissionRead {
+		t.Errorf("Expected read-only MGT0 of 1024 words at 0x60000000, generated %v %v words at %#x %v\n",
+			n.Permission(), n.Size(), n.Address(), n.Mode())
+	}
+	if n, err := top.GetNode("MGT15"); err != nil || n.Address() != 0x6000f000 {
+		t.Errorf("Expected MGT15 at 0x6000f000, generated %v\n", err)
+	}
+}
+
+func TestParseAddressTableErrors(t *testing.T) {
+	for _, tc := range []struct {
+		table string
+		err   error
+	}{
+		{`<node><node id="A" address="0xZZ"/></node>`, ErrNodeAttribute},
+		{`<node><node id="A" permission="x"/></node>`, ErrNodeAttribute},
+		{`<node><node id="A.B"/></node>`, ErrNodeAttribute},
+		{`<node><node id="A"/><node id="A"/></node>`, ErrDuplicateNode},
+		{`<node><node id="A" module="file://missing.xml"/></node>`, nil},
+	} {
+		_, err := ParseAddressTable(strings.NewReader(tc.table), "testdata")
+		if err == nil || (tc.err != nil && !errors.Is(err, tc.err)) {
+			t.Errorf("Expected %v, generated %v\n", tc.err, err)
+		}
+	}
+}
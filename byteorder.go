@@ -0,0 +1,58 @@
+// GoIPbus packet byte order
+
+package goipbus
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"unsafe"
+)
+
+// NativeEndian packets carry their words in the byte order of the host that
+// builds them, byte-order qualifier 0x0. The receiver tells the order from
+// the packet header.
+const NativeEndian = Endian_ness
+
+// Byte order of the host, the order of the words of NativeEndian packets
+var hostByteOrder binary.ByteOrder = func() binary.ByteOrder {
+	x := uint32(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// Reverse the bytes of every whole word of b in place
+func swapWords(b []byte) {
+	for i := 0; i+4 <= len(b); i += 4 {
+		binary.BigEndian.PutUint32(b[i:], bits.ReverseBytes32(binary.BigEndian.Uint32(b[i:])))
+	}
+}
+
+// Whether word is a packet header of either byte-order qualifier
+func validPacketHeader(word uint32) bool {
+	ph := IPbusPacketHeader(word)
+	return ph.Version() == IPbusProtocolVersion && word&0x0f000000 == 0 &&
+		(ph.ByteOrder() == BigEndian || ph.ByteOrder() == NativeEndian) &&
+		ph.Type() <= RequestPacket
+}
+
+// Tell whether the first word of a packet, read big-endian, is a byte
+// swapped packet header. Words that are a header in neither order are
+// reported unswapped.
+func packetSwapped(b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+	word := binary.BigEndian.Uint32(b)
+	return !validPacketHeader(word) && validPacketHeader(bits.ReverseBytes32(word))
+}
+
+// Packet header at the start of b, whatever its byte order
+func readPacketHeader(b []byte) IPbusPacketHeader {
+	word := binary.BigEndian.Uint32(b)
+	if packetSwapped(b) {
+		word = bits.ReverseBytes32(word)
+	}
+	return IPbusPacketHeader(word)
+}
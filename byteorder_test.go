@@ -0,0 +1,118 @@
+package goipbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Bytes of the words in the given order
+func orderedBytes(order binary.ByteOrder, word ...uint32) []byte {
+	var b []byte
+	for _, w := range word {
+		var buf [4]byte
+		order.PutUint32(buf[:], w)
+		b = append(b, buf[:]...)
+	}
+	return b
+}
+
+func TestSessionByteOrder(t *testing.T) {
+	s := NewSession()
+	if s.ByteOrder() != BigEndian {
+		t.Errorf("Expected byte order %#x, generated %#x\n", BigEndian, s.ByteOrder())
+	}
+	if err := s.SetByteOrder(0x5); err != ErrByteOrder {
+		t.Errorf("Expected %v, generated %v\n", ErrByteOrder, err)
+	}
+	if err := s.SetByteOrder(NativeEndian); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+
+	cp := new(IPbusControlPacket)
+	cp.Append(NewReadRequest(0x10, 2))
+	b := make([]byte, cp.RequestSize())
+	n, err := s.Encode(cp, b)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	expected := orderedBytes(hostByteOrder, 0x20000000, 0x2000020f, 0x10)
+	if !bytes.Equal(b[:n], expected) {
+		t.Errorf("Expected %#x, generated %#x\n", expected, b[:n])
+	}
+}
+
+func TestDecodeControlPacketByteOrder(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		order binary.ByteOrder
+		ph    uint32
+	}{
+		{"native big-endian", binary.BigEndian, 0x20000500},
+		{"native little-endian", binary.LittleEndian, 0x20000500},
+		{"swapped big-endian", binary.LittleEndian, 0x200005f0},
+	} {
+		b := orderedBytes(test.order, test.ph, 0x20010200, 0xa, 0xb, 0x20020110)
+		ph, resps, err := DecodeControlPacket(b)
+		if err != nil {
+			t.Fatalf("%s: Error %v\n", test.name, err)
+		}
+		if uint32(ph) != test.ph || len(resps) != 2 {
+			t.Fatalf("%s: Expected header %#x and 2 responses, generated %#x and %v\n", test.name, test.ph, ph, len(resps))
+		}
+		d := resps[0].Data()
+		if len(d) != 2 || d[0] != 0xa || d[1] != 0xb || resps[1].typeId != WriteTypeID {
+			t.Errorf("%s: Expected read of 0xa 0xb and a write, generated %#x %v\n", test.name, d, resps[1].typeId)
+		}
+	}
+}
+
+func TestDetectPacketHeader(t *testing.T) {
+	for _, test := range []struct {
+		word     uint32
+		expected int
+	}{
+		{0x200001f0, IPBUS_ISTREAM_PACKET},
+		{0xf0010020, IPBUS_ISTREAM_PACKET_SWP_ORD},
+		{0x20000100, IPBUS_ISTREAM_PACKET},
+		{0x00010020, IPBUS_ISTREAM_PACKET_SWP_ORD},
+		// read request transactions with ID 0, in both orders
+		{0x2000010f, 0},
+		{0x0f010020, 0},
+	} {
+		if s := detectPacketHeader(test.word); s != test.expected {
+			t.Errorf("Expected state %v for %#x, generated %v\n", test.expected, test.word, s)
+		}
+	}
+}
+
+func TestNativeEndianClients(t *testing.T) {
+	srv := NewServer(NewRAM(0x100))
+	tcpAddr, udpAddr := testServer(t, srv)
+	defer srv.Close()
+
+	for _, uri := range []string{TCPScheme + "://" + tcpAddr, UDPScheme + "://" + udpAddr} {
+		c, err := Open(uri)
+		if err != nil {
+			t.Fatalf("Error %v\n", err)
+		}
+		defer c.Close()
+		c.Session().SetByteOrder(NativeEndian)
+
+		cp := new(IPbusControlPacket)
+		cp.Append(NewWriteRequest(0x10, []IPbusWord{0x1, 0x2}))
+		cp.Append(NewReadRequest(0x10, 2))
+		cp.Append(NewRMWsumRequest(0x11, 0x10))
+		resps, err := c.Dispatch(cp)
+		if err != nil {
+			t.Fatalf("%s: Error %v\n", uri, err)
+		}
+		d := resps[1].Data()
+		if len(d) != 2 || d[0] != 0x1 || d[1] != 0x2 || resps[2].Data()[0] != 0x2 {
+			t.Errorf("%s: Expected 0x1 0x2 0x2, generated %#x %#x\n", uri, d, resps[2].Data())
+		}
+		if peekServer(srv, 0x11) != 0x12 {
+			t.Errorf("%s: Expected memory 0x12, generated %#x\n", uri, peekServer(srv, 0x11))
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// GoIPbus ControlHub TCP transport
+
+package goipbus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// URI scheme of the ControlHub TCP transport, e.g.
+// chtcp-2.0://localhost:10203?target=board:50001
+const ControlHubScheme = "chtcp-2.0"
+
+// Bytes of the ControlHub request preamble after the byte count: target IP
+// address, target port and number of words of the packet
+const controlHubRequestHeaderSize = 8
+
+// Bytes of the ControlHub reply preamble after the byte count: chunk byte
+// count, target IP address, target port and error code
+const controlHubReplyHeaderSize = 12
+
+// Error when a ControlHub URI has no valid target
+var ErrControlHubTarget = errors.New("IPbus ControlHub URI without a valid IPv4 target")
+
+// ControlHubErrorCode is the status the ControlHub returns with every reply
+type ControlHubErrorCode uint16
+
+const (
+	ControlHubSuccess ControlHubErrorCode = 0x0
+	// The target did not reply to the packet
+	ControlHubTargetTimeout ControlHubErrorCode = 0x1
+	// The ControlHub timed out waiting for its own status request
+	ControlHubStatusTimeout ControlHubErrorCode = 0x2
+	// The target replied with a malformed status packet, or through the
+	// GoIPbus proxy a malformed control packet
+	ControlHubMalformedStatus ControlHubErrorCode = 0x3
+	// The target replied with an unsupported protocol version
+	ControlHubProtocolVersion ControlHubErrorCode = 0x4
+	// The GoIPbus proxy could not forward the packet of the client
+	ControlHubBadRequest ControlHubErrorCode = 0x5
+)
+
+func (code ControlHubErrorCode) String() string {
+	switch code {
+	case ControlHubSuccess:
+		return "success"
+	case ControlHubTargetTimeout:
+		return "no reply from the target"
+	case ControlHubStatusTimeout:
+		return "ControlHub internal timeout"
+	case ControlHubMalformedStatus:
+		return "malformed status packet from the target"
+	case ControlHubProtocolVersion:
+		return "incorrect protocol version from the target"
+	case ControlHubBadRequest:
+		return "request not forwarded by the proxy"
+	}
+	return fmt.Sprintf("error code %#x", uint16(code))
+}
+
+// ControlHubError reports a reply of the ControlHub without IPbus packet.
+// Timeouts of the target unwrap to ErrTimeout.
+type ControlHubError struct {
+	Code   ControlHubErrorCode
+	Target string
+}
+
+func (e *ControlHubError) Error() string {
+	return fmt.Sprintf("IPbus ControlHub: %v (target %v)", e.Code, e.Target)
+}
+
+func (e *ControlHubError) Unwrap() error {
+	switch e.Code {
+	case ControlHubTargetTimeout, ControlHubStatusTimeout:
+		return ErrTimeout
+	}
+	return nil
+}
+
+// ControlHubClient sends IPbus control packets to a target through a
+// ControlHub, which multiplexes the packets of many clients, uHAL or Go, onto
+// a single board.
+//
+// Each packet is prefixed with its byte count, the IPv4 address and port of
+// the target and its number of words; the ControlHub answers with the byte
+// count, the target and an error code before the reply packet. Dispatch calls
+// from several goroutines are serialised.
+type ControlHubClient struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	r       *bufio.Reader
+	target  *net.UDPAddr
+	session *Session
+	// Timeout bounds the wait for each reply, DefaultTimeout if zero. The
+	// ControlHub has its own timeout towards the target, it should be shorter.
+	Timeout time.Duration
+}
+
+// DialControlHub connects to the ControlHub of a
+// chtcp-2.0://host:port?target=host:port URI
+func DialControlHub(uri string) (*ControlHubClient, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != ControlHubScheme {
+		return nil, errSchemeNotSupported
+	}
+	target, err := net.ResolveUDPAddr("udp4", u.Query().Get("target"))
+	if err != nil || target.IP.To4() == nil || target.Port == 0 {
+		return nil, ErrControlHubTarget
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	return &ControlHubClient{conn: conn, r: bufio.NewReader(conn), target: target,
+		session: NewSession(), Timeout: DefaultTimeout}, nil
+}
+
+// Dispatch sends the control packet through the ControlHub and decodes the
+// reply of the target
+func (c *ControlHubClient) Dispatch(cp *IPbusControlPacket) (resps []IPbusResponse, err error) {
+	return c.DispatchContext(context.Background(), cp)
+}
+
+// DispatchContext is Dispatch aborted when ctx is done. A reply interrupted
+// by a timeout or a cancellation leaves the stream out of step: the client
+// should be closed.
+func (c *ControlHubClient) DispatchContext(ctx context.Context, cp *IPbusControlPacket) (resps []IPbusResponse, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err = contextDone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 4+controlHubRequestHeaderSize+cp.RequestSize())
+	n, err := c.session.Encode(cp, b[4+controlHubRequestHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(b[0:], uint32(controlHubRequestHeaderSize+n))
+	copy(b[4:], c.target.IP.To4())
+	binary.BigEndian.PutUint16(b[8:], uint16(c.target.Port))
+	binary.BigEndian.PutUint16(b[10:], uint16(n/4))
+
+	err = c.conn.SetDeadline(contextDeadline(ctx, c.Timeout))
+	if err != nil {
+		return nil, err
+	}
+	stop := watchContext(ctx, c.conn.SetDeadline)
+	defer stop()
+	_, err = c.conn.Write(b[:4+controlHubRequestHeaderSize+n])
+	if err != nil {
+		return nil, contextError(ctx, streamError(err))
+	}
+
+	reply, err := c.readReply()
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	ph, resps, err := DecodeControlPacket(reply)
+	if err != nil {
+		return resps, err
+	}
+	if ph != cp.ph {
+		return resps, errReplyMismatch
+	}
+	return resps, cp.checkReply(resps)
+}
+
+// Read a ControlHub reply and return its IPbus packet
+func (c *ControlHubClient) readReply() ([]byte, error) {
+	b := make([]byte, 4)
+	_, err := io.ReadFull(c.r, b)
+	if err != nil {
+		return nil, streamError(err)
+	}
+	size := binary.BigEndian.Uint32(b)
+	if size < controlHubReplyHeaderSize || size > maxDatagramSize {
+		return nil, &DecodeError{Offset: 0, Err: ErrUnexpectedEOF}
+	}
+	b = make([]byte, size)
+	_, err = io.ReadFull(c.r, b)
+	if err != nil {
+		return nil, streamError(err)
+	}
+	ip := net.IP(b[4:8])
+	port := int(binary.BigEndian.Uint16(b[8:]))
+	if !ip.Equal(c.target.IP) || port != c.target.Port {
+		return nil, errReplyMismatch
+	}
+	code := ControlHubErrorCode(binary.BigEndian.Uint16(b[10:]))
+	if code != ControlHubSuccess {
+		return nil, &ControlHubError{Code: code, Target: c.target.String()}
+	}
+	return b[controlHubReplyHeaderSize:], nil
+}
+
+// Session returns the ID sequences used with the target
+func (c *ControlHubClient) Session() *Session {
+	return c.session
+}
+
+// Target returns the address of the target behind the ControlHub
+func (c *ControlHubClient) Target() *net.UDPAddr {
+	return c.target
+}
+
+// Close closes the connection to the ControlHub
+func (c *ControlHubClient) Close() error {
+	return c.conn.Close()
+}
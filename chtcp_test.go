@@ -0,0 +1,133 @@
+package goipbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Minimal ControlHub: every packet is forwarded over UDP to the target named
+// in its preamble and the reply, or a target timeout, is sent back
+func controlHubStandIn(t *testing.T) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go controlHubStandInServe(conn)
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func controlHubStandInServe(conn net.Conn) {
+	defer conn.Close()
+	for {
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		b = make([]byte, binary.BigEndian.Uint32(b))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		target := &net.UDPAddr{IP: net.IP(b[0:4]), Port: int(binary.BigEndian.Uint16(b[4:]))}
+		words := int(binary.BigEndian.Uint16(b[6:]))
+		packet := b[8 : 8+4*words]
+
+		code := ControlHubSuccess
+		var reply []byte
+		udp, err := net.DialUDP("udp", nil, target)
+		if err != nil {
+			return
+		}
+		udp.Write(packet)
+		udp.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		rb := make([]byte, maxDatagramSize)
+		n, err := udp.Read(rb)
+		udp.Close()
+		if err != nil {
+			code = ControlHubTargetTimeout
+		} else {
+			reply = rb[:n]
+		}
+
+		out := make([]byte, 16, 16+len(reply))
+		binary.BigEndian.PutUint32(out[0:], uint32(12+len(reply)))
+		binary.BigEndian.PutUint32(out[4:], uint32(8+len(reply)))
+		copy(out[8:], target.IP.To4())
+		binary.BigEndian.PutUint16(out[12:], uint16(target.Port))
+		binary.BigEndian.PutUint16(out[14:], uint16(code))
+		conn.Write(append(out, reply...))
+	}
+}
+
+func TestControlHubClient(t *testing.T) {
+	srv := NewServer(NewRAM(0x100))
+	_, udpAddr := testServer(t, srv)
+	defer srv.Close()
+	hub, stop := controlHubStandIn(t)
+	defer stop()
+
+	c, err := Open(ControlHubScheme + "://" + hub + "?target=" + udpAddr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+	if _, ok := c.(*ControlHubClient); !ok {
+		t.Fatalf("Expected ControlHubClient, generated %T\n", c)
+	}
+
+	data := []IPbusWord{0x1, 0x2, 0x3}
+	if err := WriteBlock(c, 0x10, data); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	readed, err := ReadBlock(c, 0x10, len(data))
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	for i := range data {
+		if readed[i] != data[i] {
+			t.Errorf("Expected %#x, generated %#x\n", data, readed)
+			break
+		}
+	}
+	if peekServer(srv, 0x12) != 0x3 {
+		t.Errorf("Expected memory 0x3, generated %#x\n", peekServer(srv, 0x12))
+	}
+}
+
+func TestControlHubClientTargetTimeout(t *testing.T) {
+	// A target that never answers
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer silent.Close()
+	hub, stop := controlHubStandIn(t)
+	defer stop()
+
+	c, err := DialControlHub(ControlHubScheme + "://" + hub + "?target=" + silent.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+
+	_, err = ReadBlock(c, 0x0, 1)
+	var che *ControlHubError
+	if !errors.As(err, &che) || che.Code != ControlHubTargetTimeout || !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected ControlHub target timeout, generated %v\n", err)
+	}
+
+	if _, err := DialControlHub(ControlHubScheme + "://" + hub); err != ErrControlHubTarget {
+		t.Errorf("Expected ErrControlHubTarget, generated %v\n", err)
+	}
+}
@@ -0,0 +1,62 @@
+// ipbusproxy lets many clients share IPbus targets: their control packets are
+// serialised onto a single UDP session per target with rewritten packet IDs.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	goipbus "github.com/efarres/GoIPbus"
+)
+
+func main() {
+	chtcpAddr := flag.String("chtcp", fmt.Sprintf(":%d", goipbus.DefaultControlHubPort), "listen address of the chtcp-2.0 clients, empty to disable")
+	tcpAddr := flag.String("tcp", "", "listen address of the plain IPbus TCP clients, requires -target")
+	target := flag.String("target", "", "UDP target host:port of the plain IPbus TCP clients")
+	timeout := flag.Duration("timeout", goipbus.DefaultTimeout, "time to wait for each reply of the targets")
+	flag.Parse()
+
+	if *tcpAddr != "" && *target == "" {
+		log.Fatalf("-tcp requires a -target")
+	}
+	p := goipbus.NewProxy(*target)
+	p.Timeout = *timeout
+
+	// shut down gracefully on Ctrl-C
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	done := make(chan error, 2)
+	if *chtcpAddr != "" {
+		l, err := net.Listen("tcp", *chtcpAddr)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		log.Printf("serving chtcp-2.0 clients on %v", *chtcpAddr)
+		go func() { done <- p.ServeControlHub(l) }()
+	}
+	if *tcpAddr != "" {
+		l, err := net.Listen("tcp", *tcpAddr)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		log.Printf("serving IPbus TCP clients on %v for %v", *tcpAddr, *target)
+		go func() { done <- p.ServeTCP(l) }()
+	}
+	if *chtcpAddr == "" && *tcpAddr == "" {
+		log.Fatalf("nothing to serve")
+	}
+
+	select {
+	case <-sig:
+		log.Printf("shutting down")
+	case err := <-done:
+		log.Printf("%v", err)
+	}
+	p.Close()
+}
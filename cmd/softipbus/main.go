@@ -0,0 +1,88 @@
+// softipbus serves an IPbus 2.0 target over TCP and UDP, the Go counterpart
+// of the softipbus serve-tcp daemon.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	goipbus "github.com/efarres/GoIPbus"
+)
+
+var (
+	tcpAddr = flag.String("tcp", fmt.Sprintf(":%d", goipbus.DefaultTCPPort), "TCP listen address, empty to disable")
+	udpAddr = flag.String("udp", fmt.Sprintf(":%d", goipbus.DefaultUDPPort), "UDP listen address, empty to disable")
+	backend = flag.String("mem", "ram", "memory backend: ram, null or mmap")
+	size    = flag.Int("size", 1024*1024, "memory size in 32-bit words")
+	device  = flag.String("dev", goipbus.DefaultMemoryDevice, "device or file mapped by the mmap backend")
+	base    = flag.Int64("base", 0, "physical base address in bytes mapped by the mmap backend")
+	tx      = flag.String("tx", os.Getenv("IPBUS_FORWARD_TX"), "forward the transactions to the front-end on this serial device")
+	rx      = flag.String("rx", os.Getenv("IPBUS_FORWARD_RX"), "serial device answered by the front-end, same as -tx if empty")
+	baud    = flag.Int("baud", goipbus.DefaultBaud, "baud rate of the forwarding serial devices")
+	timeout = flag.Duration("timeout", goipbus.DefaultTimeout, "time to wait for each front-end response")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Serve the target until it is interrupted, the memory and the forwarder are
+// closed on return
+func run() error {
+	var mem goipbus.MemoryBackend
+	switch *backend {
+	case "ram":
+		mem = goipbus.NewRAM(*size)
+	case "null":
+		mem = goipbus.NullMemory{}
+	case "mmap":
+		m, err := goipbus.OpenMappedMemory(*device, *base, *size)
+		if err != nil {
+			return fmt.Errorf("mapping %v @ %#x: %v", *device, *base, err)
+		}
+		defer m.Close()
+		mem = m
+	default:
+		return fmt.Errorf("unknown memory backend %q", *backend)
+	}
+	srv := goipbus.NewServer(mem)
+	if *tx != "" {
+		f, err := goipbus.OpenForwarder(*tx, *rx, *baud, *timeout)
+		if err != nil {
+			return fmt.Errorf("opening %v: %v", *tx, err)
+		}
+		defer f.Close()
+		log.Printf("forwarding transactions with TX: %v and RX: %v", *tx, *rx)
+		srv = goipbus.NewForwardingServer(f)
+	}
+	defer srv.Close()
+
+	// shut down gracefully on Ctrl-C
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	done := make(chan error, 2)
+	for _, l := range []struct{ network, addr string }{{"tcp", *tcpAddr}, {"udp", *udpAddr}} {
+		if l.addr == "" {
+			continue
+		}
+		l := l
+		log.Printf("serving %v memory on %v %v", *backend, l.network, l.addr)
+		go func() { done <- srv.ListenAndServe(l.network, l.addr) }()
+	}
+
+	select {
+	case <-sig:
+		log.Printf("shutting down")
+		return nil
+	case err := <-done:
+		return err
+	}
+}
@@ -0,0 +1,254 @@
+package goipbus
+
+// Conformance with the softipbus C target: the vectors of
+// cactuscore/softipbus/tests/serialization.c and packethandler.c run against
+// the GoIPbus encoder and decoder and against the Go target.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/bits"
+	"testing"
+)
+
+// Transaction handler answering as dummyhandlers.c: reads return 1, 2, ...
+// and the read/modify/writes are computed on the address
+type dummyHandler struct{}
+
+func (dummyHandler) handleTransaction(req *IPbusRequest) IPbusResponse {
+	resp := IPbusResponse{id: req.id, words: req.words, typeId: req.typeId, infoCode: RequestHandledSuccesfully}
+	switch req.typeId {
+	case ReadTypeID, NonIncrementalReadTypeID:
+		for i := 0; i < int(req.words); i++ {
+			resp.data = append(resp.data, IPbusWord(i+1))
+		}
+	case RMWbitsTypeID:
+		resp.data = []IPbusWord{IPbusWord(req.addr)&req.data[0] | req.data[1]}
+	case RMWsumTypeID:
+		resp.data = []IPbusWord{IPbusWord(req.addr) + req.data[0]}
+	}
+	return resp
+}
+
+// Words of b in big-endian order
+func bytesWords(b []byte) []uint32 {
+	w := make([]uint32, len(b)/4)
+	for i := range w {
+		w[i] = binary.BigEndian.Uint32(b[4*i:])
+	}
+	return w
+}
+
+func equalWords(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Transaction vectors: the request words, as built by ipbus_transaction_header
+// and the payload, with the request built by GoIPbus. -0x41100532 is
+// 0xbeefface, -0x41103502 0xbeefcafe, -0x21504111 0xdeafbeef and -0x05314111
+// 0xfacebeef.
+var conformanceTransactions = []struct {
+	name    string
+	words   []uint32
+	id      IPbusTransactionID
+	req     *IPbusRequest
+	payload int
+}{
+	{"decode_transaction", []uint32{0x2ace050f, 0xbeefface}, 0xace, NewReadRequest(-0x41100532, 5), 1},
+	{"decode_transaction_header", []uint32{0x2fee050f, 0xbeefface}, 0xfee, NewReadRequest(-0x41100532, 5), 1},
+	{"decode_write_transaction_header", []uint32{0x2fee051f, 0xbeefface, 0, 1, 2, 3, 4}, 0xfee,
+		NewWriteRequest(-0x41100532, []IPbusWord{0, 1, 2, 3, 4}), 6},
+	{"decode_encode_write_transaction", []uint32{0x2ace051f, 0xbeefface, 0, 1, 2, 3, 4}, 0xace,
+		NewWriteRequest(-0x41100532, []IPbusWord{0, 1, 2, 3, 4}), 6},
+	{"build_fake_packet read", []uint32{0x2bad050f, 0xbeefcafe}, 0xbad, NewReadRequest(-0x41103502, 5), 1},
+	{"build_fake_packet rmw", []uint32{0x2cab014f, 0xbeefcafe, 0xdeafbeef, 0xfacebeef}, 0xcab,
+		NewRMWbitsRequest(-0x41103502, -0x21504111, -0x05314111), 3},
+}
+
+func TestConformanceTransactionEncode(t *testing.T) {
+	for _, test := range conformanceTransactions {
+		s := NewSession()
+		s.setTransactionID(test.id)
+		tr := *test.req
+		if _, err := tr.encode(s); err != nil {
+			t.Fatalf("%s: Error %v\n", test.name, err)
+		}
+		if w := bytesWords(tr.b); !equalWords(w, test.words) {
+			t.Errorf("%s: Expected %#x, generated %#x\n", test.name, test.words, w)
+		}
+	}
+}
+
+func TestConformanceTransactionDecode(t *testing.T) {
+	for _, test := range conformanceTransactions {
+		for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+			p := new(StreamParser)
+			p.Write(orderedBytes(order, 0x200000f0))
+			p.PacketHeader()
+			in := orderedBytes(order, test.words...)
+			// all but the last word is a partial transaction
+			p.Write(in[:len(in)-4])
+			if s := p.State(); s != IPBUS_ISTREAM_PARTIAL_TRANS {
+				t.Errorf("%s: Expected stream state %v, generated %v\n", test.name, IPBUS_ISTREAM_PARTIAL_TRANS, s)
+			}
+			p.Write(in[len(in)-4:])
+			req, err := p.Transaction()
+			if err != nil {
+				t.Fatalf("%s: Error %v\n", test.name, err)
+			}
+			if req.id != test.id || req.words != test.req.words || req.typeId != test.req.typeId ||
+				req.infoCode != OutboundRequest || req.addr != test.req.addr {
+				t.Errorf("%s: Expected %+v, generated %+v\n", test.name, *test.req, req)
+			}
+			if size := requestPayloadSize(req.words, req.typeId, req.infoCode); size != test.payload {
+				t.Errorf("%s: Expected payload %v, generated %v\n", test.name, test.payload, size)
+			}
+			for i := range req.data {
+				if uint32(req.data[i]) != test.words[2+i] {
+					t.Errorf("%s: Expected data %#x, generated %#x\n", test.name, test.words[2:], req.data)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestConformanceHeaders(t *testing.T) {
+	// test_ipbus_transaction_header
+	th := IPbusTransactionHeader(0x5ace071e)
+	if th>>28 != 5 || (th>>16)&0xfff != 0xace || (th>>8)&0xff != 7 || (th>>4)&0xf != 1 || th&0xf != 0xe {
+		t.Errorf("Expected fields 5 0xace 7 1 0xe, generated header %#x\n", th)
+	}
+
+	// test_ipbus_packet_header
+	s := NewSession()
+	s.SetPacketID(0xfade)
+	s.mu.Lock()
+	ph, err := s.encodePacketHeader(BigEndian, RequestPacket)
+	s.mu.Unlock()
+	if err != nil || uint32(ph) != 0x20fadef2 {
+		t.Errorf("Expected 0x20fadef2, generated %#x %v\n", ph, err)
+	}
+
+	// test_ipbus_detect_packet_header
+	for _, test := range []struct {
+		word     uint32
+		expected int
+	}{
+		{0x20beeff0, IPBUS_ISTREAM_PACKET},
+		{bits.ReverseBytes32(0x20beeff0), IPBUS_ISTREAM_PACKET_SWP_ORD},
+		{0xdeadbeef, 0},
+		// ipbus_transaction_header(2, 0xEEF, IPBUS_READ, 2, 0xf)
+		{0x2eef002f, 0},
+	} {
+		if s := detectPacketHeader(test.word); s != test.expected {
+			t.Errorf("Expected %v for %#x, generated %v\n", test.expected, test.word, s)
+		}
+	}
+
+	// test_ipbus_transaction_payload_size
+	for _, test := range []struct {
+		words    uint8
+		typeId   IPbusTransactionTypeID
+		request  int
+		response int
+	}{
+		{5, ReadTypeID, 1, 5},
+		{5, NonIncrementalReadTypeID, 1, 5},
+		{5, WriteTypeID, 6, 0},
+		{5, NonIncrementalWriteTypeID, 6, 0},
+		// the number of words is ignored
+		{9, RMWbitsTypeID, 3, 1},
+		{7, RMWsumTypeID, 2, 1},
+	} {
+		if n := requestPayloadSize(test.words, test.typeId, OutboundRequest); n != test.request {
+			t.Errorf("Expected request payload %v for type %v, generated %v\n", test.request, test.typeId, n)
+		}
+		if n := responsePayloadSize(test.words, test.typeId, RequestHandledSuccesfully); n != test.response {
+			t.Errorf("Expected response payload %v for type %v, generated %v\n", test.response, test.typeId, n)
+		}
+	}
+}
+
+// Packet vectors: a request stream and the reply of the target
+var conformancePackets = []struct {
+	name  string
+	in    []uint32
+	reply []uint32
+}{
+	{"process_input_stream_empty_pkt", nil, nil},
+	{"process_input_stream_hdr_pkt", []uint32{0x20beeff0}, []uint32{0x20beeff0}},
+	{"process_full_pkt_reply",
+		[]uint32{0x20beeff0, 0x2bad050f, 0xbeefcafe, 0x2cab014f, 0xbeefcafe, 0xdeafbeef, 0xfacebeef},
+		[]uint32{0x20beeff0, 0x2bad0500, 1, 2, 3, 4, 5, 0x2cab0140, (0xbeefcafe & 0xdeafbeef) | 0xfacebeef}},
+}
+
+func TestConformanceTarget(t *testing.T) {
+	for _, test := range conformancePackets {
+		for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+			c := &streamClient{input: orderedBytes(order, test.in...)}
+			if n := processInputStream(c, dummyHandler{}); n != len(test.in) {
+				t.Errorf("%s: Expected %v words processed, generated %v\n", test.name, len(test.in), n)
+			}
+			if len(test.in) > 0 && c.swapbytes != (order == binary.LittleEndian) {
+				t.Errorf("%s: Expected swapped %v, generated %v\n", test.name, order == binary.LittleEndian, c.swapbytes)
+			}
+			if expected := orderedBytes(order, test.reply...); len(c.input) != 0 || !bytes.Equal(c.output, expected) {
+				t.Errorf("%s: Expected %#x, generated %#x\n", test.name, expected, c.output)
+			}
+		}
+	}
+}
+
+func TestConformanceClient(t *testing.T) {
+	for _, test := range conformancePackets {
+		if len(test.reply) == 0 {
+			continue
+		}
+		for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+			ph, resps, err := DecodeControlPacket(orderedBytes(order, test.reply...))
+			if err != nil {
+				t.Fatalf("%s: Error %v\n", test.name, err)
+			}
+			if uint32(ph) != test.reply[0] {
+				t.Errorf("%s: Expected header %#x, generated %#x\n", test.name, test.reply[0], ph)
+			}
+			// re-encode the responses as the target does
+			c := new(streamClient)
+			c.push(uint32(ph))
+			for i := range resps {
+				pushResponse(c, &resps[i])
+			}
+			if w := bytesWords(c.output); !equalWords(w, test.reply) {
+				t.Errorf("%s: Expected %#x, generated %#x\n", test.name, test.reply, w)
+			}
+		}
+	}
+
+	// build_fake_packet from the GoIPbus encoder, one packet per transaction
+	// since the session numbers the transactions consecutively
+	for _, test := range conformanceTransactions[4:] {
+		s := NewSession()
+		s.SetPacketID(0xbeef)
+		s.setTransactionID(test.id)
+		cp := new(IPbusControlPacket)
+		cp.Append(test.req)
+		b := make([]byte, cp.RequestSize())
+		n, err := s.Encode(cp, b)
+		if err != nil {
+			t.Fatalf("%s: Error %v\n", test.name, err)
+		}
+		expected := append([]uint32{0x20beeff0}, test.words...)
+		if w := bytesWords(b[:n]); !equalWords(w, expected) {
+			t.Errorf("%s: Expected %#x, generated %#x\n", test.name, expected, w)
+		}
+	}
+}
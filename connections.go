@@ -0,0 +1,179 @@
+// GoIPbus uHAL connection files
+
+package goipbus
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Connection file errors
+var ErrConnectionNotFound = errors.New("IPbus connection not found")
+var ErrConnectionAttribute = errors.New("IPbus connection invalid attribute")
+var ErrDuplicateConnection = errors.New("IPbus duplicate connection id")
+
+// ConnectionError records the connection id an error refers to
+type ConnectionError struct {
+	ID  string
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("%v: %q", e.Err, e.ID)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// Connection is an entry of a uHAL connection file
+type Connection struct {
+	ID  string
+	URI string
+	// AddressTable is the path of the address table, resolved relative to
+	// the connection file, empty if the connection has none
+	AddressTable string
+}
+
+// XML representation of a connection file
+type xmlConnections struct {
+	Connections []struct {
+		ID           string `xml:"id,attr"`
+		URI          string `xml:"uri,attr"`
+		AddressTable string `xml:"address_table,attr"`
+	} `xml:"connection"`
+}
+
+// ConnectionManager opens the devices of uHAL connection files, as
+// etc/test_connections.xml, selecting the transport from the URI scheme of
+// each connection and attaching its address table
+type ConnectionManager struct {
+	ids         []string
+	connections map[string]Connection
+
+	mu     sync.Mutex
+	tables map[string]*Node
+}
+
+// LoadConnections reads the connection files in names. As in uHAL several
+// files may be given separated by semicolons, each optionally prefixed by
+// file://.
+func LoadConnections(names string) (*ConnectionManager, error) {
+	cm := newConnectionManager()
+	for _, name := range strings.Split(names, ";") {
+		name = strings.TrimPrefix(strings.TrimSpace(name), "file://")
+		if name == "" {
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		err = cm.parse(f, filepath.Dir(name))
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	return cm, nil
+}
+
+// ParseConnections reads a uHAL connection file from r, address tables are
+// resolved relative to dir
+func ParseConnections(r io.Reader, dir string) (*ConnectionManager, error) {
+	cm := newConnectionManager()
+	err := cm.parse(r, dir)
+	if err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
+
+func newConnectionManager() *ConnectionManager {
+	return &ConnectionManager{connections: make(map[string]Connection), tables: make(map[string]*Node)}
+}
+
+func (cm *ConnectionManager) parse(r io.Reader, dir string) error {
+	d := xml.NewDecoder(r)
+	d.CharsetReader = charsetReader
+	x := new(xmlConnections)
+	err := d.Decode(x)
+	if err != nil {
+		return err
+	}
+	for _, xc := range x.Connections {
+		if xc.ID == "" || xc.URI == "" {
+			return &ConnectionError{ID: xc.ID, Err: ErrConnectionAttribute}
+		}
+		if _, ok := cm.connections[xc.ID]; ok {
+			return &ConnectionError{ID: xc.ID, Err: ErrDuplicateConnection}
+		}
+		c := Connection{ID: xc.ID, URI: xc.URI}
+		if xc.AddressTable != "" {
+			c.AddressTable = strings.TrimPrefix(xc.AddressTable, "file://")
+			if !filepath.IsAbs(c.AddressTable) {
+				c.AddressTable = filepath.Join(dir, c.AddressTable)
+			}
+		}
+		cm.connections[c.ID] = c
+		cm.ids = append(cm.ids, c.ID)
+	}
+	return nil
+}
+
+// GetDevices returns the ids of the connections in the order of the files
+func (cm *ConnectionManager) GetDevices() []string {
+	return append([]string(nil), cm.ids...)
+}
+
+// Connection returns the connection with the given id
+func (cm *ConnectionManager) Connection(id string) (Connection, error) {
+	c, ok := cm.connections[id]
+	if !ok {
+		return Connection{}, &ConnectionError{ID: id, Err: ErrConnectionNotFound}
+	}
+	return c, nil
+}
+
+// GetDevice connects to the device with the given id. Address tables are
+// loaded once and shared by the devices using them.
+func (cm *ConnectionManager) GetDevice(id string) (*Device, error) {
+	c, err := cm.Connection(id)
+	if err != nil {
+		return nil, err
+	}
+	var table *Node
+	if c.AddressTable != "" {
+		table, err = cm.addressTable(c.AddressTable)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client, err := Open(c.URI)
+	if err != nil {
+		return nil, &ConnectionError{ID: id, Err: err}
+	}
+	d := NewDevice(client, table)
+	d.id = id
+	return d, nil
+}
+
+func (cm *ConnectionManager) addressTable(name string) (*Node, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if table, ok := cm.tables[name]; ok {
+		return table, nil
+	}
+	table, err := LoadAddressTable(name)
+	if err != nil {
+		return nil, err
+	}
+	cm.tables[name] = table
+	return table, nil
+}
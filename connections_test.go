@@ -0,0 +1,88 @@
+package goipbus
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoadConnections(t *testing.T) {
+	cm, err := LoadConnections("file://cactuscore/softipbus/etc/test_connections.xml")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	ids := cm.GetDevices()
+	expected := []string{"ctp6.test", "ctp6.frontend.test", "dummy.controlhubtest"}
+	if len(ids) != len(expected) {
+		t.Fatalf("Expected %v, generated %v\n", expected, ids)
+	}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Errorf("Expected %v, generated %v\n", expected, ids)
+		}
+	}
+	c, err := cm.Connection("ctp6.test")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if c.URI != "ipbustcp-2.0://localhost:60002" || c.AddressTable != "cactuscore/softipbus/etc/test_address.xml" {
+		t.Errorf("Expected ctp6.test connection, generated %+v\n", c)
+	}
+	if _, err := cm.GetDevice("ctp6.missing"); !errors.Is(err, ErrConnectionNotFound) {
+		t.Errorf("Expected ErrConnectionNotFound, generated %v\n", err)
+	}
+
+	_, err = ParseConnections(strings.NewReader(`<connections>
+  <connection id="a" uri="ipbusudp-2.0://localhost:50001"/>
+  <connection id="a" uri="ipbusudp-2.0://localhost:50002"/>
+</connections>`), "")
+	if !errors.Is(err, ErrDuplicateConnection) {
+		t.Errorf("Expected ErrDuplicateConnection, generated %v\n", err)
+	}
+}
+
+func TestConnectionManagerGetDevice(t *testing.T) {
+	srv := NewServer(NewRAM(0x1000))
+	tcpAddr, udpAddr := testServer(t, srv)
+	defer srv.Close()
+
+	cm, err := ParseConnections(strings.NewReader(`<connections>
+  <connection id="board.tcp" uri="ipbustcp-2.0://`+tcpAddr+`" address_table="file://test_address.xml"/>
+  <connection id="board.udp" uri="ipbusudp-2.0://`+udpAddr+`" address_table="file://test_address.xml"/>
+</connections>`), "cactuscore/softipbus/etc")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	tcp, err := cm.GetDevice("board.tcp")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer tcp.Close()
+	udp, err := cm.GetDevice("board.udp")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer udp.Close()
+	if tcp.ID() != "board.tcp" || tcp.AddressTable() != udp.AddressTable() {
+		t.Errorf("Expected board.tcp sharing the address table, generated %v\n", tcp.ID())
+	}
+	if _, ok := tcp.Client().(*TCPClient); !ok {
+		t.Errorf("Expected TCPClient, generated %T\n", tcp.Client())
+	}
+	if _, ok := udp.Client().(*UDPClient); !ok {
+		t.Errorf("Expected UDPClient, generated %T\n", udp.Client())
+	}
+
+	n, err := tcp.GetNode("REG")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if err := n.Write(0x1234); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	n, _ = udp.GetNode("REG")
+	v, err := n.Read()
+	if err != nil || v != 0x1234 {
+		t.Errorf("Expected 0x1234, generated %#x %v\n", v, err)
+	}
+}
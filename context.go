@@ -0,0 +1,69 @@
+// GoIPbus context support
+
+package goipbus
+
+import (
+	"context"
+	"time"
+)
+
+// A deadline in the past, interrupting any blocked I/O
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Deadline of an operation bounded by both timeout and ctx
+func contextDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// Interrupt the blocked I/O of a connection, through its setDeadline method,
+// as soon as ctx is done. stop must be called once the I/O is over; the
+// deadline has then to be set again before the next I/O.
+func watchContext(ctx context.Context, setDeadline func(time.Time) error) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			setDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// Error of ctx once it is done or its deadline has passed: the I/O deadline
+// set from ctx may expire just before ctx itself is done
+func contextDone(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// Report the cancellation or the deadline of ctx rather than the I/O error it
+// caused
+func contextError(ctx context.Context, err error) error {
+	if err != nil {
+		if cerr := contextDone(ctx); cerr != nil {
+			return cerr
+		}
+	}
+	return err
+}
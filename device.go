@@ -0,0 +1,292 @@
+// GoIPbus devices: a target reached through a client and described by an
+// address table
+
+package goipbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+)
+
+// Error when a value does not fit in the mask of a node
+var ErrValueOutOfRange = errors.New("IPbus value does not fit in the node mask")
+
+// Error when an operation does not apply to the mode of a node
+var ErrNodeMode = errors.New("IPbus operation not supported by the node mode")
+
+// Error when the permission of a node does not allow an operation
+var ErrPermission = errors.New("IPbus operation not permitted on the node")
+
+// PermissionError reports a read of a write-only node or a write of a
+// read-only node. It is returned before any packet is built.
+type PermissionError struct {
+	Path string
+	// Permission of the node
+	Permission Permission
+	// Operation rejected, PermissionRead or PermissionWrite
+	Op Permission
+}
+
+func (e *PermissionError) Error() string {
+	op := "read"
+	if e.Op == PermissionWrite {
+		op = "write"
+	}
+	return fmt.Sprintf("IPbus %s not permitted on node %q with permission %v", op, e.Path, e.Permission)
+}
+
+func (e *PermissionError) Unwrap() error {
+	return ErrPermission
+}
+
+// Device is a target reached through an IPbusClient whose registers are
+// described by an address table
+type Device struct {
+	id     string
+	client IPbusClient
+	table  *Node
+	// IgnorePermissions lets the nodes be read and written whatever their
+	// permission, for expert debugging only
+	IgnorePermissions bool
+
+	// transactions waiting for Dispatch
+	mu    sync.Mutex
+	queue []queuedRequest
+}
+
+// NewDevice returns a device using client c and the address table top
+func NewDevice(c IPbusClient, table *Node) *Device {
+	return &Device{client: c, table: table}
+}
+
+// ID returns the connection id of the device, empty if not created by a
+// ConnectionManager
+func (d *Device) ID() string {
+	return d.id
+}
+
+// Client returns the client connected to the target
+func (d *Device) Client() IPbusClient {
+	return d.client
+}
+
+// AddressTable returns the top node of the address table
+func (d *Device) AddressTable() *Node {
+	return d.table
+}
+
+// Close closes the client
+func (d *Device) Close() error {
+	return d.client.Close()
+}
+
+// DeviceNode is an address table node bound to the device it belongs to
+type DeviceNode struct {
+	*Node
+	dev *Device
+}
+
+// GetNode returns the node of the address table with the dotted path "A.B.C"
+func (d *Device) GetNode(path string) (*DeviceNode, error) {
+	if d.table == nil {
+		return nil, &NodeError{Path: path, Err: ErrNodeNotFound}
+	}
+	n, err := d.table.GetNode(path)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceNode{Node: n, dev: d}, nil
+}
+
+// Check that the permission of the node allows op
+func (n *DeviceNode) allow(op Permission) error {
+	if n.dev.IgnorePermissions || n.permission&op != 0 {
+		return nil
+	}
+	return &PermissionError{Path: n.path, Permission: n.permission, Op: op}
+}
+
+// Position of the least significant bit of the mask
+func (n *DeviceNode) shift() uint {
+	return uint(bits.TrailingZeros32(uint32(n.mask)))
+}
+
+// Whether the node covers the whole register
+func (n *DeviceNode) masked() bool {
+	return uint32(n.mask) != 0xffffffff
+}
+
+// Read returns the value of a single register node. The bits selected by the
+// mask are shifted down to bit 0.
+func (n *DeviceNode) Read() (IPbusWord, error) {
+	return n.ReadContext(context.Background())
+}
+
+// ReadContext is Read aborted when ctx is done
+func (n *DeviceNode) ReadContext(ctx context.Context) (IPbusWord, error) {
+	if n.mode == ModeHierarchical {
+		return 0, &NodeError{Path: n.path, Err: ErrNodeMode}
+	}
+	if err := n.allow(PermissionRead); err != nil {
+		return 0, err
+	}
+	resps, err := dispatchRequestsContext(ctx, n.dev.client, []*IPbusRequest{NewReadRequest(n.address, 1)})
+	if err != nil {
+		return 0, err
+	}
+	v := uint32(resps[0].data[0])
+	return IPbusWord((v & uint32(n.mask)) >> n.shift()), nil
+}
+
+// Write stores v in a single register node. Masked nodes are written with a
+// RMWbits transaction, shifting v to the position of the mask, so that the
+// other bits of the register are preserved atomically on the target.
+func (n *DeviceNode) Write(v IPbusWord) error {
+	return n.WriteContext(context.Background(), v)
+}
+
+// WriteContext is Write aborted when ctx is done
+func (n *DeviceNode) WriteContext(ctx context.Context, v IPbusWord) error {
+	if n.mode == ModeHierarchical {
+		return &NodeError{Path: n.path, Err: ErrNodeMode}
+	}
+	if err := n.allow(PermissionWrite); err != nil {
+		return err
+	}
+	var rq *IPbusRequest
+	if n.masked() {
+		field := uint32(v) << n.shift()
+		if field>>n.shift() != uint32(v) || field&^uint32(n.mask) != 0 {
+			return &NodeError{Path: n.path, Err: ErrValueOutOfRange}
+		}
+		rq = NewRMWbitsRequest(n.address, ^n.mask, IPbusWord(field))
+	} else {
+		rq = NewWriteRequest(n.address, []IPbusWord{v})
+	}
+	_, err := dispatchRequestsContext(ctx, n.dev.client, []*IPbusRequest{rq})
+	return err
+}
+
+// ReadBlock reads size words of an incremental or non-incremental node
+func (n *DeviceNode) ReadBlock(size int) ([]IPbusWord, error) {
+	return n.ReadBlockContext(context.Background(), size)
+}
+
+// ReadBlockContext is ReadBlock aborted when ctx is done
+func (n *DeviceNode) ReadBlockContext(ctx context.Context, size int) ([]IPbusWord, error) {
+	if size < 0 {
+		return nil, ErrBlockSize
+	}
+	if err := n.allow(PermissionRead); err != nil {
+		return nil, err
+	}
+	var reqs []*IPbusRequest
+	switch n.mode {
+	case ModeIncremental:
+		reqs = NewBlockReadRequests(n.address, size)
+	case ModeNonIncremental:
+		reqs = NewBlockNonIncrementalReadRequests(n.address, size)
+	default:
+		return nil, &NodeError{Path: n.path, Err: ErrNodeMode}
+	}
+	resps, err := dispatchRequestsContext(ctx, n.dev.client, reqs)
+	if err != nil {
+		return nil, err
+	}
+	return joinResponses(resps, size), nil
+}
+
+// WriteBlock writes data into an incremental or non-incremental node
+func (n *DeviceNode) WriteBlock(data []IPbusWord) error {
+	return n.WriteBlockContext(context.Background(), data)
+}
+
+// WriteBlockContext is WriteBlock aborted when ctx is done
+func (n *DeviceNode) WriteBlockContext(ctx context.Context, data []IPbusWord) error {
+	if err := n.allow(PermissionWrite); err != nil {
+		return err
+	}
+	var reqs []*IPbusRequest
+	switch n.mode {
+	case ModeIncremental:
+		reqs = NewBlockWriteRequests(n.address, data)
+	case ModeNonIncremental:
+		reqs = NewBlockNonIncrementalWriteRequests(n.address, data)
+	default:
+		return &NodeError{Path: n.path, Err: ErrNodeMode}
+	}
+	_, err := dispatchRequestsContext(ctx, n.dev.client, reqs)
+	return err
+}
+
+// RMWBits sets the word at addr to (old & and) | or in a single transaction,
+// atomically on the target, and returns the old value
+func (d *Device) RMWBits(addr BaseAddress, and, or IPbusWord) (old IPbusWord, err error) {
+	return d.RMWBitsContext(context.Background(), addr, and, or)
+}
+
+// RMWBitsContext is RMWBits aborted when ctx is done
+func (d *Device) RMWBitsContext(ctx context.Context, addr BaseAddress, and, or IPbusWord) (old IPbusWord, err error) {
+	return d.rmw(ctx, NewRMWbitsRequest(addr, and, or))
+}
+
+// RMWSum adds addend to the word at addr in a single transaction, atomically
+// on the target, and returns the old value
+func (d *Device) RMWSum(addr BaseAddress, addend IPbusWord) (old IPbusWord, err error) {
+	return d.RMWSumContext(context.Background(), addr, addend)
+}
+
+// RMWSumContext is RMWSum aborted when ctx is done
+func (d *Device) RMWSumContext(ctx context.Context, addr BaseAddress, addend IPbusWord) (old IPbusWord, err error) {
+	return d.rmw(ctx, NewRMWsumRequest(addr, addend))
+}
+
+// Dispatch a read/modify/write request and return the word before the update
+func (d *Device) rmw(ctx context.Context, rq *IPbusRequest) (IPbusWord, error) {
+	resps, err := dispatchRequestsContext(ctx, d.client, []*IPbusRequest{rq})
+	if err != nil {
+		return 0, err
+	}
+	return resps[0].data[0], nil
+}
+
+// SetBits sets the bits of mask in the word at addr and returns the old value
+func (d *Device) SetBits(addr BaseAddress, mask IPbusWord) (old IPbusWord, err error) {
+	return d.SetBitsContext(context.Background(), addr, mask)
+}
+
+// SetBitsContext is SetBits aborted when ctx is done
+func (d *Device) SetBitsContext(ctx context.Context, addr BaseAddress, mask IPbusWord) (old IPbusWord, err error) {
+	return d.RMWBitsContext(ctx, addr, -1, mask)
+}
+
+// ClearBits clears the bits of mask in the word at addr and returns the old
+// value
+func (d *Device) ClearBits(addr BaseAddress, mask IPbusWord) (old IPbusWord, err error) {
+	return d.ClearBitsContext(context.Background(), addr, mask)
+}
+
+// ClearBitsContext is ClearBits aborted when ctx is done
+func (d *Device) ClearBitsContext(ctx context.Context, addr BaseAddress, mask IPbusWord) (old IPbusWord, err error) {
+	return d.RMWBitsContext(ctx, addr, ^mask, 0)
+}
+
+// ToggleBits inverts the bits of mask in the word at addr and returns the old
+// value. IPbus has no exclusive or: the word is read first, then the inverted
+// bits are written with RMWbits, so a change of the same bits by another
+// client between the two transactions is overwritten.
+func (d *Device) ToggleBits(addr BaseAddress, mask IPbusWord) (old IPbusWord, err error) {
+	return d.ToggleBitsContext(context.Background(), addr, mask)
+}
+
+// ToggleBitsContext is ToggleBits aborted when ctx is done
+func (d *Device) ToggleBitsContext(ctx context.Context, addr BaseAddress, mask IPbusWord) (old IPbusWord, err error) {
+	resps, err := dispatchRequestsContext(ctx, d.client, []*IPbusRequest{NewReadRequest(addr, 1)})
+	if err != nil {
+		return 0, err
+	}
+	return d.RMWBitsContext(ctx, addr, ^mask, ^resps[0].data[0]&mask)
+}
@@ -0,0 +1,263 @@
+package goipbus
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// Client recording the control packets and transaction types dispatched
+type recordingClient struct {
+	IPbusClient
+	packets int
+	types   []IPbusTransactionTypeID
+}
+
+func (c *recordingClient) Dispatch(cp *IPbusControlPacket) ([]IPbusResponse, error) {
+	return c.DispatchContext(context.Background(), cp)
+}
+
+func (c *recordingClient) DispatchContext(ctx context.Context, cp *IPbusControlPacket) ([]IPbusResponse, error) {
+	c.packets++
+	for _, rq := range cp.reqs {
+		c.types = append(c.types, rq.typeId)
+	}
+	return c.IPbusClient.DispatchContext(ctx, cp)
+}
+
+// Device on a Server with RAM and the test address table
+func testDevice(t *testing.T) (*Device, *Server, *recordingClient) {
+	table, err := LoadAddressTable("cactuscore/softipbus/etc/test_address.xml")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	srv := NewServer(NewRAM(0x1000))
+	_, udpAddr := testServer(t, srv)
+	c, err := Open(UDPScheme + "://" + udpAddr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	rc := &recordingClient{IPbusClient: c}
+	return NewDevice(rc, table), srv, rc
+}
+
+func TestDeviceNodeMask(t *testing.T) {
+	d, srv, rc := testDevice(t)
+	defer srv.Close()
+	defer d.Close()
+
+	upper, err := d.GetNode("REG_UPPER_MASK")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	lower, err := d.GetNode("REG_LOWER_MASK")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	reg, err := d.GetNode("REG")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+
+	if err := upper.Write(0xabcd); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if err := lower.Write(0x1234); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if v := uint32(peekServer(srv, 0x4)); v != 0xabcd1234 {
+		t.Errorf("Expected memory 0xabcd1234, generated %#x\n", v)
+	}
+	if err := upper.Write(0x5678); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if v := uint32(peekServer(srv, 0x4)); v != 0x56781234 {
+		t.Errorf("Expected memory 0x56781234, generated %#x\n", v)
+	}
+	v, err := upper.Read()
+	if err != nil || v != 0x5678 {
+		t.Errorf("Expected 0x5678, generated %#x %v\n", v, err)
+	}
+	v, err = lower.Read()
+	if err != nil || v != 0x1234 {
+		t.Errorf("Expected 0x1234, generated %#x %v\n", v, err)
+	}
+	for i, typeId := range rc.types[:3] {
+		if typeId != RMWbitsTypeID {
+			t.Errorf("Expected RMWbits for write %d, generated %v\n", i, typeId)
+		}
+	}
+
+	// Full registers are written with a plain write
+	rc.types = nil
+	if err := reg.Write(-1); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	v, err = reg.Read()
+	if err != nil || v != -1 {
+		t.Errorf("Expected 0xffffffff, generated %#x %v\n", v, err)
+	}
+	if len(rc.types) != 2 || rc.types[0] != WriteTypeID {
+		t.Errorf("Expected write and read, generated %v\n", rc.types)
+	}
+
+	err = lower.Write(0x10000)
+	if !errors.Is(err, ErrValueOutOfRange) {
+		t.Errorf("Expected ErrValueOutOfRange, generated %v\n", err)
+	}
+	if v := uint32(peekServer(srv, 0x4)); v != 0x56781234 {
+		t.Errorf("Expected memory 0x56781234, generated %#x\n", v)
+	}
+}
+
+func TestDeviceNodeBlock(t *testing.T) {
+	d, srv, _ := testDevice(t)
+	defer srv.Close()
+	defer d.Close()
+
+	mem, err := d.GetNode("MEM")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	data := []IPbusWord{0x1, 0x2, 0x3, 0x4}
+	if err := mem.WriteBlock(data); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	readed, err := mem.ReadBlock(len(data))
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	for i := range data {
+		if readed[i] != data[i] {
+			t.Errorf("Expected %#x, generated %#x\n", data, readed)
+			break
+		}
+	}
+	if _, err := mem.Read(); err != nil {
+		t.Errorf("Expected read of the first word, generated %v\n", err)
+	}
+	if _, err := mem.ReadBlock(-1); err != ErrBlockSize {
+		t.Errorf("Expected %v, generated %v\n", ErrBlockSize, err)
+	}
+
+	top, _ := d.GetNode("")
+	if _, err := top.Read(); !errors.Is(err, ErrNodeMode) {
+		t.Errorf("Expected ErrNodeMode, generated %v\n", err)
+	}
+	reg, _ := d.GetNode("REG")
+	if err := reg.WriteBlock(data); !errors.Is(err, ErrNodeMode) {
+		t.Errorf("Expected ErrNodeMode, generated %v\n", err)
+	}
+}
+
+func TestDeviceNodePermission(t *testing.T) {
+	d, srv, rc := testDevice(t)
+	defer srv.Close()
+	defer d.Close()
+
+	ro, _ := d.GetNode("REG_READ_ONLY")
+	wo, _ := d.GetNode("REG_WRITE_ONLY")
+
+	err := ro.Write(0x1)
+	var pe *PermissionError
+	if !errors.As(err, &pe) || pe.Op != PermissionWrite || pe.Path != "REG_READ_ONLY" {
+		t.Errorf("Expected write PermissionError, generated %v\n", err)
+	}
+	if err := ro.WriteBlock([]IPbusWord{0x1}); !errors.Is(err, ErrPermission) {
+		t.Errorf("Expected ErrPermission, generated %v\n", err)
+	}
+	_, err = wo.Read()
+	if !errors.As(err, &pe) || pe.Op != PermissionRead {
+		t.Errorf("Expected read PermissionError, generated %v\n", err)
+	}
+	if len(rc.types) != 0 {
+		t.Errorf("Expected no transaction dispatched, generated %v\n", rc.types)
+	}
+	if _, err := ro.Read(); err != nil {
+		t.Errorf("Expected read permitted, generated %v\n", err)
+	}
+	if err := wo.Write(0x2); err != nil {
+		t.Errorf("Expected write permitted, generated %v\n", err)
+	}
+
+	d.IgnorePermissions = true
+	if err := ro.Write(0x3); err != nil {
+		t.Errorf("Expected override, generated %v\n", err)
+	}
+	v, err := wo.Read()
+	if err != nil || v != 0x2 {
+		t.Errorf("Expected 0x2, generated %#x %v\n", v, err)
+	}
+	if peekServer(srv, 0x2) != 0x3 {
+		t.Errorf("Expected memory 0x3, generated %#x\n", peekServer(srv, 0x2))
+	}
+}
+
+func TestDeviceRMW(t *testing.T) {
+	d, srv, rc := testDevice(t)
+	defer srv.Close()
+	defer d.Close()
+
+	srv.busMu.Lock()
+	srv.Memory.WriteWord(0x10, 0x00ff00f0)
+	srv.busMu.Unlock()
+
+	old, err := d.RMWBits(0x10, 0x0000ffff, 0x12000000)
+	if err != nil || old != 0x00ff00f0 {
+		t.Errorf("Expected old value 0xff00f0, generated %#x %v\n", old, err)
+	}
+	if v := peekServer(srv, 0x10); v != 0x120000f0 {
+		t.Errorf("Expected memory 0x120000f0, generated %#x\n", v)
+	}
+	old, err = d.RMWSum(0x10, 0x10)
+	if err != nil || old != 0x120000f0 {
+		t.Errorf("Expected old value 0x120000f0, generated %#x %v\n", old, err)
+	}
+	if v := peekServer(srv, 0x10); v != 0x12000100 {
+		t.Errorf("Expected memory 0x12000100, generated %#x\n", v)
+	}
+
+	for _, test := range []struct {
+		name     string
+		op       func(BaseAddress, IPbusWord) (IPbusWord, error)
+		mask     IPbusWord
+		old      IPbusWord
+		expected IPbusWord
+	}{
+		{"SetBits", d.SetBits, 0x0000000f, 0x12000100, 0x1200010f},
+		{"ClearBits", d.ClearBits, 0x12000000, 0x1200010f, 0x0000010f},
+		{"ToggleBits", d.ToggleBits, 0x00000ff0, 0x0000010f, 0x00000eff},
+	} {
+		old, err := test.op(0x10, test.mask)
+		if err != nil || old != test.old {
+			t.Errorf("%s: Expected old value %#x, generated %#x %v\n", test.name, test.old, old, err)
+		}
+		if v := peekServer(srv, 0x10); v != test.expected {
+			t.Errorf("%s: Expected memory %#x, generated %#x\n", test.name, test.expected, v)
+		}
+	}
+	if rc.types[0] != RMWbitsTypeID || rc.types[1] != RMWsumTypeID {
+		t.Errorf("Expected RMWbits and RMWsum transactions, generated %v\n", rc.types)
+	}
+
+	// Bus errors are reported, no value is returned
+	_, err = d.RMWSum(0x1000, 1)
+	if ie, ok := err.(*InfoCodeError); !ok || ie.InfoCode != BusErrorOnRead {
+		t.Errorf("Expected bus error on read, generated %v\n", err)
+	}
+
+	// A cancelled context sends nothing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	id := rc.Session().TransactionID()
+	for _, op := range []func(context.Context, BaseAddress, IPbusWord) (IPbusWord, error){
+		d.SetBitsContext, d.ClearBitsContext, d.ToggleBitsContext,
+	} {
+		if _, err = op(ctx, 0x10, 0x1); err != context.Canceled {
+			t.Errorf("Expected %v, generated %v\n", context.Canceled, err)
+		}
+	}
+	if rc.Session().TransactionID() != id {
+		t.Errorf("Expected no packet sent, generated transaction ID %v\n", rc.Session().TransactionID())
+	}
+}
@@ -0,0 +1,220 @@
+// GoIPbus serial forwarding target, ported from the softipbus forwarding
+// transaction handler
+
+package goipbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// Period of the reads polling the forwarding serial devices
+const linePollInterval = 100 * time.Millisecond
+
+// Error when the receive line of a Forwarder is closed
+var errForwardingClosed = errors.New("IPbus forwarding line closed")
+
+// Forwarder passes every transaction received by a Server to a front-end over
+// a serial TX/RX pair, as softipbus-forward, and waits for its response. The
+// front-end speaks the framing of SerialClient: raw big-endian transactions
+// without packet header.
+//
+// A front-end that does not answer within Timeout gets a BusTimeOutOnRead or
+// BusTimeOutOnWrite response; any late data it sends is discarded before the
+// next transaction is forwarded.
+type Forwarder struct {
+	tx      io.Writer
+	closers []io.Closer
+	rx      chan []byte
+	// closed by Close, stops the receiver
+	done      chan struct{}
+	closeOnce sync.Once
+	// received bytes not consumed yet
+	pending []byte
+	// Timeout bounds the wait for each response, DefaultTimeout if zero
+	Timeout time.Duration
+}
+
+// OpenForwarder opens the tx and rx serial devices at the given baud rate,
+// rx may be the same device as tx
+func OpenForwarder(tx, rx string, baud int, timeout time.Duration) (*Forwarder, error) {
+	if baud == 0 {
+		baud = DefaultBaud
+	}
+	txPort, err := serial.OpenPort(&serial.Config{Name: tx, Baud: baud, ReadTimeout: linePollInterval})
+	if err != nil {
+		return nil, err
+	}
+	if rx == "" || rx == tx {
+		f := newForwarder(txPort, pollingLine{txPort}, timeout)
+		f.closers = []io.Closer{txPort}
+		return f, nil
+	}
+	rxPort, err := serial.OpenPort(&serial.Config{Name: rx, Baud: baud, ReadTimeout: linePollInterval})
+	if err != nil {
+		txPort.Close()
+		return nil, err
+	}
+	f := newForwarder(txPort, pollingLine{rxPort}, timeout)
+	f.closers = []io.Closer{txPort, rxPort}
+	return f, nil
+}
+
+// The read timeout of a serial line is reported as end of file: keep polling
+// the line, so that closing it never waits on a blocked read
+type pollingLine struct {
+	io.Reader
+}
+
+func (l pollingLine) Read(b []byte) (n int, err error) {
+	n, err = l.Reader.Read(b)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Forward over an already opened pair
+func newForwarder(tx io.Writer, rx io.Reader, timeout time.Duration) *Forwarder {
+	f := &Forwarder{tx: tx, rx: make(chan []byte, 16), done: make(chan struct{}), Timeout: timeout}
+	go f.receive(rx)
+	return f
+}
+
+// Collect the data sent by the front-end until the line or the forwarder is
+// closed
+func (f *Forwarder) receive(rx io.Reader) {
+	defer close(f.rx)
+	for {
+		b := make([]byte, maxRequestSize)
+		n, err := rx.Read(b)
+		if n > 0 {
+			select {
+			case f.rx <- b[:n]:
+			case <-f.done:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Close closes the serial devices
+func (f *Forwarder) Close() error {
+	f.closeOnce.Do(func() { close(f.done) })
+	var err error
+	for _, c := range f.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// NewForwardingServer returns a server forwarding every transaction with f
+func NewForwardingServer(f *Forwarder) *Server {
+	return &Server{Memory: NullMemory{}, handler: f}
+}
+
+// Discard the data received before the transaction was sent
+func (f *Forwarder) flush() {
+	f.pending = nil
+	for {
+		select {
+		case _, ok := <-f.rx:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Read the next n bytes sent by the front-end before the timer expires
+func (f *Forwarder) read(n int, timer <-chan time.Time) ([]byte, error) {
+	for len(f.pending) < n {
+		select {
+		case b, ok := <-f.rx:
+			if !ok {
+				return nil, errForwardingClosed
+			}
+			f.pending = append(f.pending, b...)
+		case <-timer:
+			return nil, ErrTimeout
+		}
+	}
+	b := append([]byte(nil), f.pending[:n]...)
+	f.pending = f.pending[n:]
+	return b, nil
+}
+
+// Forward a request transaction and wait for the response of the front-end
+func (f *Forwarder) handleTransaction(req *IPbusRequest) IPbusResponse {
+	resp := IPbusResponse{id: req.id, words: req.words, typeId: req.typeId}
+
+	// Once in forwarding land the transaction is always big endian
+	b := make([]byte, 0, 8+4*len(req.data))
+	b = appendWord(b, IPbusProtocolVersion<<28|uint32(req.id&0xfff)<<16|
+		uint32(req.words)<<8|uint32(req.typeId&0xf)<<4|uint32(OutboundRequest))
+	b = appendWord(b, uint32(req.addr))
+	for _, v := range req.data {
+		b = appendWord(b, uint32(v))
+	}
+
+	f.flush()
+	_, err := f.tx.Write(b)
+	if err != nil {
+		return forwardingError(resp, err)
+	}
+
+	timeout := f.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	th, err := f.read(4, timer.C)
+	if err != nil {
+		return forwardingError(resp, err)
+	}
+	word := binary.BigEndian.Uint32(th)
+	size := responsePayloadSize(uint8(word>>8), IPbusTransactionTypeID((word>>4)&0xf), IPbusInfoCode(word&0xf))
+	payload, err := f.read(4*size, timer.C)
+	if err != nil {
+		return forwardingError(resp, err)
+	}
+	_, err = resp.Decode(append(th, payload...))
+	if err != nil || resp.id != req.id || resp.typeId != req.typeId {
+		resp = IPbusResponse{id: req.id, words: req.words, typeId: req.typeId}
+		return forwardingError(resp, err)
+	}
+	return resp
+}
+
+// Error response to a transaction that could not be forwarded: timeouts are
+// reported as bus timeouts, anything else as bus errors
+func forwardingError(resp IPbusResponse, err error) IPbusResponse {
+	write := false
+	switch resp.typeId {
+	case WriteTypeID, NonIncrementalWriteTypeID, ConfigurationSpaceWrite:
+		write = true
+	}
+	switch {
+	case errors.Is(err, ErrTimeout) && write:
+		return busError(resp, BusTimeOutOnWrite)
+	case errors.Is(err, ErrTimeout):
+		return busError(resp, BusTimeOutOnRead)
+	case write:
+		return busError(resp, BusErrorOnWrite)
+	}
+	return busError(resp, BusErrorOnRead)
+}
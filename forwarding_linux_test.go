@@ -0,0 +1,88 @@
+package goipbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestForwardingServer(t *testing.T) {
+	master, slave := openPty(t)
+	defer master.Close()
+	mem := map[BaseAddress]IPbusWord{0x6000: 0x12345678}
+	go serialStandIn(master, mem)
+
+	f, err := OpenForwarder(slave, slave, DefaultBaud, 0)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer f.Close()
+	srv := NewForwardingServer(f)
+	tcpAddr, _ := testServer(t, srv)
+	defer srv.Close()
+
+	c, err := DialTCP(tcpAddr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+
+	cp := new(IPbusControlPacket)
+	cp.Append(NewReadRequest(0x6000, 1))
+	cp.Append(NewWriteRequest(0x6010, []IPbusWord{0x1, 0x2}))
+	cp.Append(NewRMWsumRequest(0x6011, 0x3))
+	resps, err := c.Dispatch(cp)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if d := resps[0].Data(); len(d) != 1 || d[0] != 0x12345678 {
+		t.Errorf("Expected word 0x12345678, generated %#x\n", d)
+	}
+	if d := resps[2].Data(); len(d) != 1 || d[0] != 0x2 || peek(mem, 0x6011) != 0x5 {
+		t.Errorf("Expected RMWsum 0x2 -> 0x5, generated %#x -> %#x\n", d, peek(mem, 0x6011))
+	}
+}
+
+func TestForwardingServerTimeout(t *testing.T) {
+	// nobody answers on the master side
+	master, slave := openPty(t)
+	defer master.Close()
+	go func() {
+		b := make([]byte, 64)
+		for {
+			if _, err := master.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+
+	f, err := OpenForwarder(slave, "", DefaultBaud, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer f.Close()
+	srv := NewForwardingServer(f)
+	tcpAddr, _ := testServer(t, srv)
+	defer srv.Close()
+
+	c, err := DialTCP(tcpAddr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+
+	for _, tc := range []struct {
+		rq   *IPbusRequest
+		code IPbusInfoCode
+	}{
+		{NewReadRequest(0x1, 2), BusTimeOutOnRead},
+		{NewWriteRequest(0x1, []IPbusWord{0x1}), BusTimeOutOnWrite},
+	} {
+		cp := new(IPbusControlPacket)
+		cp.Append(tc.rq)
+		resps, err := c.Dispatch(cp)
+		ie, ok := err.(*InfoCodeError)
+		if !ok || ie.InfoCode != tc.code || len(resps[0].Data()) != 0 {
+			t.Errorf("Expected %v, generated %v\n", tc.code, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package goipbus
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestForwarderHandleTransaction(t *testing.T) {
+	// two pipes simulate the forwarding serial port
+	txr, txw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer txr.Close()
+	rxr, rxw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer rxw.Close()
+	f := newForwarder(txw, rxr, 100*time.Millisecond)
+	f.closers = []io.Closer{txw, rxr}
+	defer f.Close()
+
+	// RMW expects 1+1 words back
+	c := &streamClient{input: wordBytes(0x2cab014f, 0xbeefcafe, 0xdeafbeef, 0xfacebeef)}
+	done := make(chan int)
+	go func() { done <- handleTransactionStream(c, f) }()
+
+	b := make([]byte, 16)
+	_, err = io.ReadFull(txr, b)
+	if err != nil || string(b) != string(wordBytes(0x2cab014f, 0xbeefcafe, 0xdeafbeef, 0xfacebeef)) {
+		t.Errorf("Expected forwarded transaction, generated %#x (%v)\n", b, err)
+	}
+	rxw.Write(wordBytes(0x2cab0140, 0x12345678))
+	if n := <-done; n != 4 {
+		t.Errorf("Expected 4 words consumed, generated %v\n", n)
+	}
+	expected := wordBytes(0x2cab0140, 0x12345678)
+	if string(c.output) != string(expected) {
+		t.Errorf("Expected %#x, generated %#x\n", expected, c.output)
+	}
+
+	// the front-end does not answer in time, its late reply is discarded
+	c = &streamClient{input: wordBytes(0x2bad050f, 0xbeefcafe)}
+	handleTransactionStream(c, f)
+	io.ReadFull(txr, b[:8])
+	expected = wordBytes(0x2bad0506)
+	if string(c.output) != string(expected) {
+		t.Errorf("Expected %#x, generated %#x\n", expected, c.output)
+	}
+	rxw.Write(wordBytes(0x2bad0500, 0x1, 0x2, 0x3, 0x4, 0x5))
+	time.Sleep(10 * time.Millisecond)
+
+	c = &streamClient{input: wordBytes(0x2bae011f, 0x10, 0x1)}
+	go func() {
+		io.ReadFull(txr, b[:12])
+		rxw.Write(wordBytes(0x2bae0110))
+	}()
+	handleTransactionStream(c, f)
+	expected = wordBytes(0x2bae0110)
+	if string(c.output) != string(expected) {
+		t.Errorf("Expected %#x, generated %#x\n", expected, c.output)
+	}
+}
+
+// Front-end that never stops sending
+type chattyLine struct{}
+
+func (chattyLine) Read(b []byte) (n int, err error) {
+	b[0] = 0xff
+	return 1, nil
+}
+
+func TestForwarderClose(t *testing.T) {
+	f := newForwarder(io.Discard, chattyLine{}, 0)
+	time.Sleep(10 * time.Millisecond)
+	f.Close()
+
+	// The receiver stops even though nobody reads its data
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-f.rx:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Expected the receiver to stop, generated data after Close\n")
+		}
+	}
+}
@@ -20,19 +20,20 @@ func TestHeader(t *testing.T) {
 	var id IPbusTransactionID = 1
 
 	fmt.Println("Starting Test Header")
+	s := NewSession()
 
 	// Read transaction Example
 	// Ver = 0x20 PacketID = 0x0000 Byte-Order= 0x0 Packet TypeID = 0x0
 	// 0x2 000 00 0 f
 	pheader := IPbusPacketHeader(0x20000000)
-	pID := IPbusPacketHeader(packetID) << 8
+	pID := IPbusPacketHeader(s.packetID) << 8
 	order := IPbusPacketHeader(0xf) << 4
 	ptypeID := IPbusPacketHeader(0x0)
 	pheader = pheader | pID | order | ptypeID
 
 	//
 	var pword IPbusPacketHeader
-	pword, err := encodePacketHeader(0xf, ControlPacket)
+	pword, err := s.encodePacketHeader(0xf, ControlPacket)
 	if err != nil {
 		t.Errorf("Error %v\n", err)
 	}
@@ -45,12 +46,12 @@ func TestHeader(t *testing.T) {
 	// Ver = 0x20 PacketID = 0x0000 Byte-Order= 0x0 Packet TypeID = 0x0
 	// 0x2 000 00 0 f
 	pheader = IPbusPacketHeader(0x20000000)
-	pID = IPbusPacketHeader(packetID) << 8
+	pID = IPbusPacketHeader(s.packetID) << 8
 	order = IPbusPacketHeader(0xf) << 4
 	ptypeID = IPbusPacketHeader(0x0)
 	pheader = pheader | pID | order | ptypeID
 
-	pword, err = encodePacketHeader(0xf, ControlPacket)
+	pword, err = s.encodePacketHeader(0xf, ControlPacket)
 	if err != nil {
 		t.Errorf("Error %v\n", err)
 	}
@@ -59,16 +60,16 @@ func TestHeader(t *testing.T) {
 	}
 	fmt.Printf("Generated header %x\n", pheader)
 
-	err = setTransactionID(id)
+	err = s.setTransactionID(id)
 	if err != nil {
-		t.Error("Error %v", err)
+		t.Errorf("Error %v", err)
 	}
 
 	// Read transaction Example
 	// Ver = 0x2 TransID = 0x000 Words= 0x00 TypeID = 0x0, InfoCode = 0xf
 	// 0x2 000 00 0 f
 	header := IPbusTransactionHeader(0x2000000f)
-	trans := IPbusTransactionHeader(transactionID) << 16
+	trans := IPbusTransactionHeader(s.transactionID) << 16
 	words := IPbusTransactionHeader(size) << 8
 	typeID := IPbusTransactionHeader(0x0) << 4
 	infoCode := IPbusTransactionHeader(0xf)
@@ -76,7 +77,7 @@ func TestHeader(t *testing.T) {
 
 	//
 	var word0 IPbusTransactionHeader
-	word0, err = encodeTransactionHeader(ReadTypeID, size)
+	word0, err = s.encodeTransactionHeader(ReadTypeID, size)
 	if err != nil {
 		t.Errorf("Error %v\n", err)
 	}
@@ -89,13 +90,13 @@ func TestHeader(t *testing.T) {
 	// Ver = 0x2 TransID = 0x000 Words= 0x00 TypeID = 0x1, InfoCode = 0xf
 	// 0x2 000 00 1 f
 	header = IPbusTransactionHeader(0x20000000)
-	trans = IPbusTransactionHeader(transactionID) << 16
+	trans = IPbusTransactionHeader(s.transactionID) << 16
 	words = IPbusTransactionHeader(size) << 8
 	typeID = IPbusTransactionHeader(0x1) << 4
 	infoCode = IPbusTransactionHeader(0xf)
 	header = header | trans | words | typeID | infoCode
 
-	word0, err = encodeTransactionHeader(WriteTypeID, size)
+	word0, err = s.encodeTransactionHeader(WriteTypeID, size)
 	if err != nil {
 		t.Errorf("Error %v", err)
 	}
@@ -108,13 +109,13 @@ func TestHeader(t *testing.T) {
 	// Ver = 0x2 TransID = 0x000 Words= 0x00 TypeID = 0x0, InfoCode = 0xf
 	// 0x2 000 00 0 f
 	header = IPbusTransactionHeader(0x2000000f)
-	trans = IPbusTransactionHeader(transactionID) << 16
+	trans = IPbusTransactionHeader(s.transactionID) << 16
 	words = IPbusTransactionHeader(size) << 8
 	typeID = IPbusTransactionHeader(0x0) << 4
 	infoCode = IPbusTransactionHeader(0xf)
 	header = header | trans | words | typeID | infoCode
 
-	word0, err = encodeReadHeader(size)
+	word0, err = s.encodeReadHeader(size)
 	if err != nil {
 		t.Errorf("Error %v\n", err)
 	}
@@ -127,14 +128,14 @@ func TestHeader(t *testing.T) {
 	// Ver = 0x2 TransID = 0x000 Words= 0x00 TypeID = 0x1, InfoCode = 0xf
 	// 0x2 000 00 1 f
 	header = IPbusTransactionHeader(0x20000000)
-	trans = IPbusTransactionHeader(transactionID) << 16
+	trans = IPbusTransactionHeader(s.transactionID) << 16
 	words = IPbusTransactionHeader(0x8) << 8
 	typeID = IPbusTransactionHeader(0x1) << 4
 	infoCode = IPbusTransactionHeader(0xf)
 	header = header | trans | words | typeID | infoCode
 
 	data := []IPbusWord{1, 2, 3, 4, 5, 6, 7, 8}
-	word0, err = encodeWriteHeader(data)
+	word0, err = s.encodeWriteHeader(data)
 	if err != nil {
 		t.Errorf("Error %v", err)
 	}
@@ -149,14 +150,17 @@ func TestControlPackage(t *testing.T) {
 	var id IPbusTransactionID = 1
 	var addr BaseAddress = 0xEFB
 
+	// Packet ID expected by the reference buffers below
+	defaultSession.setPacketID(2)
+
 	// Set Transaction ID
-	err := setTransactionID(id)
+	err := defaultSession.setTransactionID(id)
 	if err != nil {
 		t.Errorf("Error %v\n", err)
 	}
 
 	// Set Transaction Base Address
-	err = setBaseAddress(addr)
+	err = defaultSession.setBaseAddress(addr)
 	if err != nil {
 		t.Errorf("Error %v\n", err)
 	}
@@ -175,11 +179,12 @@ func TestControlPackage(t *testing.T) {
 	}
 	fmt.Printf("Generated request %x\n", b)
 
-	// 20 0003 f 0
+	// The default session is not reliable, the packet ID stays the same
+	// 20 0002 f 0
 	// 2 002 0b 0 f
 	// 00000efb
 	bt = []byte{
-		0x20, 0x00, 0x03, 0xf0,
+		0x20, 0x00, 0x02, 0xf0,
 		0x20, 0x02, 0x0b, 0x0f,
 		0x00, 0x00, 0x0e, 0xfb,
 	}
@@ -189,17 +194,17 @@ func TestControlPackage(t *testing.T) {
 	}
 	fmt.Printf("Generated request %x\n", b)
 
-	// 20 0004 f 0
-	// 2 002 0b 0 f
+	// 20 0002 f 0
+	// 2 003 0a 0 f
 	// 00000efb
 	bt = []byte{
-		0x20, 0x00, 0x04, 0xf0,
+		0x20, 0x00, 0x02, 0xf0,
 		0x20, 0x03, 0x0a, 0x0f,
 		0x00, 0x00, 0x0e, 0xfb,
 	}
 	//
 	rq := new(IPbusRequest)
-	rq.addr = baseAddress
+	rq.addr = defaultSession.baseAddress
 	rq.data = nil
 	rq.words = size
 	if err != nil {
@@ -207,7 +212,10 @@ func TestControlPackage(t *testing.T) {
 	}
 	b = make([]byte, 12)
 	p0 := new(IPbusControlPacket)
-	p0.reqs[0] = *rq
+	err = p0.Append(rq)
+	if err != nil {
+		t.Errorf("Error %v\n", err)
+	}
 	n, err := p0.Encode(b)
 	if !bytes.Equal(bt, b) {
 		t.Errorf("Expected buffer 0x%x, generated 0x%x\n", bt, b)
@@ -221,13 +229,13 @@ func TestEncode(t *testing.T) {
 	var addr BaseAddress = 0xEFB
 
 	// Set Transaction ID
-	err := setTransactionID(id)
+	err := defaultSession.setTransactionID(id)
 	if err != nil {
 		t.Errorf("Error %v\n", err)
 	}
 
 	// Set Transaction Base Address
-	err = setBaseAddress(addr)
+	err = defaultSession.setBaseAddress(addr)
 	if err != nil {
 		t.Errorf("Error %v\n", err)
 	}
@@ -235,10 +243,10 @@ func TestEncode(t *testing.T) {
 	// Define Transaction request
 	rq := new(IPbusRequest)
 	rq.typeId = ReadTypeID
-	rq.addr = baseAddress
+	rq.addr = defaultSession.baseAddress
 	rq.data = nil
 	rq.words = size
-	rq.id = transactionID
+	rq.id = defaultSession.transactionID
 
 	// Encode method
 	n, err := rq.Encode()
@@ -287,7 +295,7 @@ func TestNewRequests(t *testing.T) {
 	var id IPbusTransactionID = 5
 
 	// Set Transaction ID
-	err := setTransactionID(id)
+	err := defaultSession.setTransactionID(id)
 	if err != nil {
 		t.Errorf("Error %v\n", err)
 	}
@@ -346,19 +354,57 @@ func TestNewRequests(t *testing.T) {
 
 }
 
+func TestRMWPacketRequests(t *testing.T) {
+	defaultSession.setPacketID(4)
+	defaultSession.setTransactionID(1)
+
+	// Packet Header: 		20 0004 f 0
+	// Transaction Header:	2 001 01 4 f
+	b, err := RMWbitsRequest(0x10, 0xff, 0x1)
+	if err != nil {
+		t.Errorf("Error %v\n", err)
+	}
+	bt := []byte{
+		0x20, 0x00, 0x04, 0xf0,
+		0x20, 0x01, 0x01, 0x4f,
+		0x00, 0x00, 0x00, 0x10,
+		0x00, 0x00, 0x00, 0xff,
+		0x00, 0x00, 0x00, 0x01,
+	}
+	if !bytes.Equal(bt, b) {
+		t.Errorf("Expected buffer 0x%x, generated 0x%x\n", bt, b)
+	}
+
+	// Packet Header: 		20 0004 f 0
+	// Transaction Header:	2 002 01 5 f
+	b, err = RMWsumRequest(0x10, 0x2)
+	if err != nil {
+		t.Errorf("Error %v\n", err)
+	}
+	bt = []byte{
+		0x20, 0x00, 0x04, 0xf0,
+		0x20, 0x02, 0x01, 0x5f,
+		0x00, 0x00, 0x00, 0x10,
+		0x00, 0x00, 0x00, 0x02,
+	}
+	if !bytes.Equal(bt, b) {
+		t.Errorf("Expected buffer 0x%x, generated 0x%x\n", bt, b)
+	}
+}
+
 func TestRead(t *testing.T) {
 	var size uint8 = 0xA
 	var id IPbusTransactionID = 1
 	var addr BaseAddress = 0xEFB
 
 	// Set Transaction ID
-	err := setTransactionID(id)
+	err := defaultSession.setTransactionID(id)
 	if err != nil {
 		t.Errorf("Error %v\n", err)
 	}
 
 	// Set Transaction Base Address
-	err = setBaseAddress(addr)
+	err = defaultSession.setBaseAddress(addr)
 	if err != nil {
 		t.Errorf("Error %v\n", err)
 	}
@@ -366,10 +412,10 @@ func TestRead(t *testing.T) {
 	// Define Transaction request
 	rq := new(IPbusRequest)
 	rq.typeId = ReadTypeID
-	rq.addr = baseAddress
+	rq.addr = defaultSession.baseAddress
 	rq.data = nil
 	rq.words = size
-	rq.id = transactionID
+	rq.id = defaultSession.transactionID
 
 	// Encode method
 	n, err := rq.Read(rq.b)
@@ -421,13 +467,13 @@ func TestWriteAt(t *testing.T) {
 	var data = []IPbusWord{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x8}
 
 	// Set Transaction ID
-	err := setTransactionID(id)
+	err := defaultSession.setTransactionID(id)
 	if err != nil {
 		t.Errorf("Error %v\n", err)
 	}
 
 	// Set Transaction Base Address
-	err = setBaseAddress(addr)
+	err = defaultSession.setBaseAddress(addr)
 	if err != nil {
 		t.Errorf("Error %v\n", err)
 	}
@@ -435,49 +481,55 @@ func TestWriteAt(t *testing.T) {
 	// Define Transaction request
 	wq := new(IPbusRequest)
 	wq.typeId = WriteTypeID
-	wq.addr = baseAddress
+	wq.addr = defaultSession.baseAddress
 	wq.data = data
 	wq.words = size
-	wq.id = transactionID
+	wq.id = defaultSession.transactionID
 	wt := []byte{
 		0x70, 0x01, 0x02, 0x03,
 		0x74, 0x05, 0x06, 0x07,
 	}
 
-	// Encode method
+	// Encode method, the Words field counts the data words written
 	n, err := wq.WriteAt(wt, int64(wq.addr))
-	// 20 0001 f 0
-	// 2 002 0b 0 f
+	// 2 001 02 1 f
 	// 00000efb
+	// 70010203 74050607
 	bt := []byte{
-		0x20, 0x01, 0x0a, 0x1f,
+		0x20, 0x01, 0x02, 0x1f,
 		0x00, 0x00, 0x0e, 0xfb,
+		0x70, 0x01, 0x02, 0x03,
+		0x74, 0x05, 0x06, 0x07,
 	}
 	if !bytes.Equal(bt, wq.b) {
-		t.Errorf("Expected buffer 0x%x, generated %#x\n", bt, wq)
+		t.Errorf("Expected buffer 0x%x, generated %#x\n", bt, wq.b)
 	}
 	fmt.Printf("Wroted %v bytes, values 0x%x\n", n, wq.b)
 
 	// Read set transaction header and
 	n, err = wq.WriteAt(wt, int64(wq.addr))
-	// 20 0002 f 0
-	// 2 002 0b 0 f
+	// 2 002 02 1 f
 	// 00000efb
+	// 70010203 74050607
 	bt = []byte{
-		0x20, 0x02, 0x0a, 0x1f,
+		0x20, 0x02, 0x02, 0x1f,
 		0x00, 0x00, 0x0e, 0xfb,
+		0x70, 0x01, 0x02, 0x03,
+		0x74, 0x05, 0x06, 0x07,
 	}
 	if !bytes.Equal(bt, wq.b) {
 		t.Errorf("Expected buffer 0x%x, generated 0x%x\n", bt, wq.b)
 	}
 	fmt.Printf("Wroted %v bytes, values 0x%x\n", n, wq.b)
 
-	// 20 0003 f 0
-	// 2 002 0b 0 f
+	// 2 003 02 1 f
 	// 00000efb
+	// 70010203 74050607
 	bt = []byte{
-		0x20, 0x03, 0x0a, 0x1f,
+		0x20, 0x03, 0x02, 0x1f,
 		0x00, 0x00, 0x0e, 0xfb,
+		0x70, 0x01, 0x02, 0x03,
+		0x74, 0x05, 0x06, 0x07,
 	}
 	n, err = wq.WriteAt(wt, int64(wq.addr))
 	if !bytes.Equal(bt, wq.b) {
@@ -0,0 +1,132 @@
+// GoIPbus target memory
+
+package goipbus
+
+import (
+	"errors"
+)
+
+// MemoryBackend is the bus served by a Server, the Go counterpart of the
+// softipbus membase. Addresses are 32-bit word addresses; an error is
+// answered with a bus error Info Code.
+//
+// The backend is selected at runtime: RAM for simulation, NullMemory when no
+// local memory is needed and MappedMemory for real hardware.
+type MemoryBackend interface {
+	ReadWord(addr BaseAddress) (IPbusWord, error)
+	WriteWord(addr BaseAddress, v IPbusWord) error
+	// ReadBlock fills p with the words starting at addr
+	ReadBlock(addr BaseAddress, p []IPbusWord) error
+	// WriteBlock stores p starting at addr
+	WriteBlock(addr BaseAddress, p []IPbusWord) error
+	// RMWBits stores (old & andTerm) | orTerm at addr and returns old
+	RMWBits(addr BaseAddress, andTerm, orTerm IPbusWord) (old IPbusWord, err error)
+	// RMWSum stores old + addend at addr and returns old
+	RMWSum(addr BaseAddress, addend IPbusWord) (old IPbusWord, err error)
+}
+
+// Error when an address falls outside of the memory backend
+var ErrBusAddress = errors.New("IPbus address out of range")
+
+// Check that n words starting at addr fit in a memory of size words
+func checkRange(addr BaseAddress, n, size int) error {
+	if addr < 0 || n > size || int(addr) > size-n {
+		return ErrBusAddress
+	}
+	return nil
+}
+
+// RAM is an in-memory MemoryBackend of len(RAM) words, as testmembase
+type RAM []IPbusWord
+
+// NewRAM returns a zeroed RAM of size words
+func NewRAM(size int) RAM {
+	return make(RAM, size)
+}
+
+// ReadWord returns the word at addr
+func (m RAM) ReadWord(addr BaseAddress) (IPbusWord, error) {
+	if err := checkRange(addr, 1, len(m)); err != nil {
+		return 0, err
+	}
+	return m[addr], nil
+}
+
+// WriteWord stores v at addr
+func (m RAM) WriteWord(addr BaseAddress, v IPbusWord) error {
+	if err := checkRange(addr, 1, len(m)); err != nil {
+		return err
+	}
+	m[addr] = v
+	return nil
+}
+
+// ReadBlock fills p with the words starting at addr
+func (m RAM) ReadBlock(addr BaseAddress, p []IPbusWord) error {
+	if err := checkRange(addr, len(p), len(m)); err != nil {
+		return err
+	}
+	copy(p, m[addr:])
+	return nil
+}
+
+// WriteBlock stores p starting at addr
+func (m RAM) WriteBlock(addr BaseAddress, p []IPbusWord) error {
+	if err := checkRange(addr, len(p), len(m)); err != nil {
+		return err
+	}
+	copy(m[addr:], p)
+	return nil
+}
+
+// RMWBits stores (old & andTerm) | orTerm at addr and returns old
+func (m RAM) RMWBits(addr BaseAddress, andTerm, orTerm IPbusWord) (old IPbusWord, err error) {
+	if err = checkRange(addr, 1, len(m)); err != nil {
+		return 0, err
+	}
+	old = m[addr]
+	m[addr] = (old & andTerm) | orTerm
+	return old, nil
+}
+
+// RMWSum stores old + addend at addr and returns old
+func (m RAM) RMWSum(addr BaseAddress, addend IPbusWord) (old IPbusWord, err error) {
+	if err = checkRange(addr, 1, len(m)); err != nil {
+		return 0, err
+	}
+	old = m[addr]
+	m[addr] = old + addend
+	return old, nil
+}
+
+// NullMemory is a MemoryBackend without storage, as nullmembase: reads return
+// zero and writes are discarded. It suits targets that forward their
+// transactions and need no local memory.
+type NullMemory struct{}
+
+func (NullMemory) ReadWord(addr BaseAddress) (IPbusWord, error) {
+	return 0, nil
+}
+
+func (NullMemory) WriteWord(addr BaseAddress, v IPbusWord) error {
+	return nil
+}
+
+func (NullMemory) ReadBlock(addr BaseAddress, p []IPbusWord) error {
+	for i := range p {
+		p[i] = 0
+	}
+	return nil
+}
+
+func (NullMemory) WriteBlock(addr BaseAddress, p []IPbusWord) error {
+	return nil
+}
+
+func (NullMemory) RMWBits(addr BaseAddress, andTerm, orTerm IPbusWord) (IPbusWord, error) {
+	return 0, nil
+}
+
+func (NullMemory) RMWSum(addr BaseAddress, addend IPbusWord) (IPbusWord, error) {
+	return 0, nil
+}
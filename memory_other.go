@@ -0,0 +1,61 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+// GoIPbus memory mapped target memory, not available on this platform
+
+package goipbus
+
+import (
+	"errors"
+)
+
+// ErrMappedMemory is returned by OpenMappedMemory where the files cannot be
+// memory mapped
+var ErrMappedMemory = errors.New("IPbus mapped memory not supported on this platform")
+
+// Default device of MappedMemory, none on this platform
+const DefaultMemoryDevice = ""
+
+// MappedMemory is the MemoryBackend mapping a device on the platforms with
+// mmap, it cannot be opened on this one
+type MappedMemory struct{}
+
+// OpenMappedMemory returns ErrMappedMemory
+func OpenMappedMemory(path string, base int64, size int) (*MappedMemory, error) {
+	return nil, ErrMappedMemory
+}
+
+// Close does nothing
+func (m *MappedMemory) Close() error {
+	return nil
+}
+
+// ReadWord returns ErrMappedMemory
+func (m *MappedMemory) ReadWord(addr BaseAddress) (IPbusWord, error) {
+	return 0, ErrMappedMemory
+}
+
+// WriteWord returns ErrMappedMemory
+func (m *MappedMemory) WriteWord(addr BaseAddress, v IPbusWord) error {
+	return ErrMappedMemory
+}
+
+// ReadBlock returns ErrMappedMemory
+func (m *MappedMemory) ReadBlock(addr BaseAddress, p []IPbusWord) error {
+	return ErrMappedMemory
+}
+
+// WriteBlock returns ErrMappedMemory
+func (m *MappedMemory) WriteBlock(addr BaseAddress, p []IPbusWord) error {
+	return ErrMappedMemory
+}
+
+// RMWBits returns ErrMappedMemory
+func (m *MappedMemory) RMWBits(addr BaseAddress, andTerm, orTerm IPbusWord) (old IPbusWord, err error) {
+	return 0, ErrMappedMemory
+}
+
+// RMWSum returns ErrMappedMemory
+func (m *MappedMemory) RMWSum(addr BaseAddress, addend IPbusWord) (old IPbusWord, err error) {
+	return 0, ErrMappedMemory
+}
@@ -0,0 +1,61 @@
+package goipbus
+
+import (
+	"testing"
+)
+
+// Exercise every operation of a MemoryBackend of at least 0x10 words
+func testMemoryBackend(t *testing.T, mem MemoryBackend) {
+	err := mem.WriteBlock(0x4, []IPbusWord{0x1, 0x2, 0x3})
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	p := make([]IPbusWord, 3)
+	err = mem.ReadBlock(0x4, p)
+	if err != nil || p[0] != 0x1 || p[1] != 0x2 || p[2] != 0x3 {
+		t.Errorf("Expected block 0x1 0x2 0x3, generated %#x (%v)\n", p, err)
+	}
+
+	err = mem.WriteWord(0x8, 0x0f0f)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	old, err := mem.RMWBits(0x8, 0xff, 0x100)
+	if err != nil || old != 0x0f0f {
+		t.Errorf("Expected old value 0xf0f, generated %#x (%v)\n", old, err)
+	}
+	old, err = mem.RMWSum(0x8, 0x1)
+	if err != nil || old != 0x010f {
+		t.Errorf("Expected old value 0x10f, generated %#x (%v)\n", old, err)
+	}
+	v, err := mem.ReadWord(0x8)
+	if err != nil || v != 0x0110 {
+		t.Errorf("Expected 0x110, generated %#x (%v)\n", v, err)
+	}
+}
+
+func TestRAM(t *testing.T) {
+	mem := NewRAM(0x10)
+	testMemoryBackend(t, mem)
+
+	if _, err := mem.ReadWord(0x10); err != ErrBusAddress {
+		t.Errorf("Expected %v, generated %v\n", ErrBusAddress, err)
+	}
+	if err := mem.WriteBlock(0xe, make([]IPbusWord, 3)); err != ErrBusAddress {
+		t.Errorf("Expected %v, generated %v\n", ErrBusAddress, err)
+	}
+	if _, err := mem.RMWSum(-1, 1); err != ErrBusAddress {
+		t.Errorf("Expected %v, generated %v\n", ErrBusAddress, err)
+	}
+}
+
+func TestNullMemory(t *testing.T) {
+	var mem NullMemory
+	if err := mem.WriteWord(0x1234, 0x5); err != nil {
+		t.Errorf("Error %v\n", err)
+	}
+	p := []IPbusWord{0x1, 0x2}
+	if err := mem.ReadBlock(0x1234, p); err != nil || p[0] != 0 || p[1] != 0 {
+		t.Errorf("Expected zero block, generated %#x (%v)\n", p, err)
+	}
+}
@@ -0,0 +1,138 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+// GoIPbus memory mapped target memory
+
+package goipbus
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// ErrMappedFileSize is returned when the words to map extend past the end of
+// a regular file, reading them would raise SIGBUS
+var ErrMappedFileSize = errors.New("IPbus mapped memory beyond the end of the file")
+
+// Default device of MappedMemory, the physical memory as devmembase
+const DefaultMemoryDevice = "/dev/mem"
+
+// MappedMemory is a MemoryBackend mapping size words of a device or regular
+// file starting at a byte offset base, e.g. the physical address of the
+// firmware registers in /dev/mem. Every word is accessed with a single
+// aligned 32-bit load or store in the host byte order.
+type MappedMemory struct {
+	f    *os.File
+	page []byte
+	// the mapped words, the start of page may precede base
+	mem []byte
+}
+
+// OpenMappedMemory maps size words of the file at path starting at base
+func OpenMappedMemory(path string, base int64, size int) (*MappedMemory, error) {
+	if base < 0 || base%4 != 0 || size <= 0 {
+		return nil, ErrBusAddress
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_SYNC, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Devices have no size, only regular files are checked
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Mode().IsRegular() && fi.Size() < base+4*int64(size) {
+		f.Close()
+		return nil, ErrMappedFileSize
+	}
+	// mmap offsets must be page aligned
+	pagesize := int64(os.Getpagesize())
+	offset := base &^ (pagesize - 1)
+	skip := int(base - offset)
+	page, err := syscall.Mmap(int(f.Fd()), offset, skip+4*size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &MappedMemory{f: f, page: page, mem: page[skip:]}, nil
+}
+
+// Close unmaps the memory and closes the file
+func (m *MappedMemory) Close() error {
+	err := syscall.Munmap(m.page)
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Pointer to the word at addr
+func (m *MappedMemory) word(addr BaseAddress) *uint32 {
+	return (*uint32)(unsafe.Pointer(&m.mem[4*int(addr)]))
+}
+
+// ReadWord returns the word at addr
+func (m *MappedMemory) ReadWord(addr BaseAddress) (IPbusWord, error) {
+	if err := checkRange(addr, 1, len(m.mem)/4); err != nil {
+		return 0, err
+	}
+	return IPbusWord(atomic.LoadUint32(m.word(addr))), nil
+}
+
+// WriteWord stores v at addr
+func (m *MappedMemory) WriteWord(addr BaseAddress, v IPbusWord) error {
+	if err := checkRange(addr, 1, len(m.mem)/4); err != nil {
+		return err
+	}
+	atomic.StoreUint32(m.word(addr), uint32(v))
+	return nil
+}
+
+// ReadBlock fills p with the words starting at addr
+func (m *MappedMemory) ReadBlock(addr BaseAddress, p []IPbusWord) error {
+	if err := checkRange(addr, len(p), len(m.mem)/4); err != nil {
+		return err
+	}
+	for i := range p {
+		p[i] = IPbusWord(atomic.LoadUint32(m.word(addr + BaseAddress(i))))
+	}
+	return nil
+}
+
+// WriteBlock stores p starting at addr
+func (m *MappedMemory) WriteBlock(addr BaseAddress, p []IPbusWord) error {
+	if err := checkRange(addr, len(p), len(m.mem)/4); err != nil {
+		return err
+	}
+	for i, v := range p {
+		atomic.StoreUint32(m.word(addr+BaseAddress(i)), uint32(v))
+	}
+	return nil
+}
+
+// RMWBits stores (old & andTerm) | orTerm at addr and returns old
+func (m *MappedMemory) RMWBits(addr BaseAddress, andTerm, orTerm IPbusWord) (old IPbusWord, err error) {
+	if err = checkRange(addr, 1, len(m.mem)/4); err != nil {
+		return 0, err
+	}
+	w := m.word(addr)
+	old = IPbusWord(atomic.LoadUint32(w))
+	atomic.StoreUint32(w, uint32((old&andTerm)|orTerm))
+	return old, nil
+}
+
+// RMWSum stores old + addend at addr and returns old
+func (m *MappedMemory) RMWSum(addr BaseAddress, addend IPbusWord) (old IPbusWord, err error) {
+	if err = checkRange(addr, 1, len(m.mem)/4); err != nil {
+		return 0, err
+	}
+	w := m.word(addr)
+	old = IPbusWord(atomic.LoadUint32(w))
+	atomic.StoreUint32(w, uint32(old+addend))
+	return old, nil
+}
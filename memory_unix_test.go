@@ -0,0 +1,66 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package goipbus
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+)
+
+// Host byte order of the mapped words
+func hostOrder() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+func TestMappedMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mem")
+	pagesize := os.Getpagesize()
+	err := os.WriteFile(path, make([]byte, 2*pagesize), 0600)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+
+	// Unaligned base inside the first page
+	base := int64(pagesize - 0x20)
+	mem, err := OpenMappedMemory(path, base, 0x10)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	testMemoryBackend(t, mem)
+	if _, err := mem.ReadWord(0x10); err != ErrBusAddress {
+		t.Errorf("Expected %v, generated %v\n", ErrBusAddress, err)
+	}
+	err = mem.Close()
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if v := hostOrder().Uint32(b[base+4*0x5:]); v != 0x2 {
+		t.Errorf("Expected word 0x2 at %#x, generated %#x\n", base+4*0x5, v)
+	}
+
+	if _, err := OpenMappedMemory(path, 0x2, 1); err != ErrBusAddress {
+		t.Errorf("Expected %v, generated %v\n", ErrBusAddress, err)
+	}
+	// The last word would be past the end of the file
+	if _, err := OpenMappedMemory(path, base, pagesize/4+0x8+1); err != ErrMappedFileSize {
+		t.Errorf("Expected %v, generated %v\n", ErrMappedFileSize, err)
+	}
+	if mem, err := OpenMappedMemory(path, base, pagesize/4+0x8); err != nil {
+		t.Errorf("Expected the whole file mapped, generated %v\n", err)
+	} else {
+		mem.Close()
+	}
+}
@@ -0,0 +1,110 @@
+package goipbus
+
+import (
+	"testing"
+)
+
+func TestControlPacketSizes(t *testing.T) {
+	cp := new(IPbusControlPacket)
+	cp.Append(NewReadRequest(0x0, 0xa))
+	cp.Append(NewWriteRequest(0x0, []IPbusWord{1, 2, 3}))
+	cp.Append(NewNonIncrementalReadRequest(0x0, 0x2))
+	cp.Append(NewRMWbitsRequest(0x0, 0x0, 0x1))
+	cp.Append(NewRMWsumRequest(0x0, 0x1))
+
+	// 4 + 8 + 20 + 8 + 16 + 12
+	if n := cp.RequestSize(); n != 68 {
+		t.Errorf("Expected request size 68, generated %v\n", n)
+	}
+	// 4 + 44 + 4 + 12 + 8 + 8
+	if n := cp.ResponseSize(); n != 80 {
+		t.Errorf("Expected response size 80, generated %v\n", n)
+	}
+	b := make([]byte, 1024)
+	n, err := cp.Encode(b)
+	if err != nil || n != cp.RequestSize() {
+		t.Errorf("Expected %v encoded bytes, generated %v (%v)\n", cp.RequestSize(), n, err)
+	}
+	_, err = cp.Encode(b[:n-1])
+	if err != ErrShortBuffer {
+		t.Errorf("Expected %v, generated %v\n", ErrShortBuffer, err)
+	}
+}
+
+func TestControlPacketFull(t *testing.T) {
+	// Each read response takes 4 + 4 + 255*4 = 1024 bytes
+	cp := new(IPbusControlPacket)
+	if err := cp.Append(NewReadRequest(0x0, 0xff)); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if err := cp.Append(NewReadRequest(0x100, 0xff)); err != ErrPacketFull {
+		t.Errorf("Expected %v, generated %v\n", ErrPacketFull, err)
+	}
+	if cp.Len() != 1 {
+		t.Errorf("Expected 1 request, generated %v\n", cp.Len())
+	}
+
+	// Request side limit: 8 + 255*4 bytes per write
+	data := make([]IPbusWord, 0xff)
+	cp = new(IPbusControlPacket)
+	cp.Append(NewWriteRequest(0x0, data))
+	if err := cp.Append(NewWriteRequest(0x100, data)); err != ErrPacketFull {
+		t.Errorf("Expected %v, generated %v\n", ErrPacketFull, err)
+	}
+}
+
+func TestPackRequests(t *testing.T) {
+	var reqs []*IPbusRequest
+	for i := 0; i < 5; i++ {
+		reqs = append(reqs, NewReadRequest(BaseAddress(i*0x100), 0xff))
+	}
+	for i := 0; i < 300; i++ {
+		reqs = append(reqs, NewWriteRequest(BaseAddress(i), []IPbusWord{IPbusWord(i)}))
+	}
+	cps, err := PackRequests(reqs)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	total := 0
+	for _, cp := range cps {
+		if cp.RequestSize() > int(maxByteSize) || cp.ResponseSize() > int(maxByteSize) {
+			t.Errorf("Packet exceeds %v bytes: request %v response %v\n", maxByteSize, cp.RequestSize(), cp.ResponseSize())
+		}
+		for i := range cp.reqs {
+			if cp.reqs[i].addr != reqs[total].addr || cp.reqs[i].typeId != reqs[total].typeId {
+				t.Errorf("Request %v out of order\n", total)
+			}
+			total++
+		}
+	}
+	if total != len(reqs) {
+		t.Errorf("Expected %v requests, generated %v\n", len(reqs), total)
+	}
+	// 5 reads need 5 packets, 300 writes need 300*12 bytes
+	if len(cps) < 7 {
+		t.Errorf("Expected at least 7 packets, generated %v\n", len(cps))
+	}
+}
+
+func TestConfigurationSpaceRequests(t *testing.T) {
+	s := NewSession()
+	s.setTransactionID(0x12)
+	rd := NewConfigurationSpaceReadRequest(0x4, 0x2)
+	wr := NewConfigurationSpaceWriteRequest(0x6, []IPbusWord{0x1, 0x2, 0x3})
+	rd.encode(s)
+	wr.encode(s)
+
+	expected := []byte{0x20, 0x12, 0x02, 0x6f, 0x00, 0x00, 0x00, 0x04}
+	if string(rd.b) != string(expected) {
+		t.Errorf("Expected %#x, generated %#x\n", expected, rd.b)
+	}
+	expected = []byte{0x20, 0x13, 0x03, 0x7f, 0x00, 0x00, 0x00, 0x06,
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x03}
+	if string(wr.b) != string(expected) {
+		t.Errorf("Expected %#x, generated %#x\n", expected, wr.b)
+	}
+	if rd.RequestSize() != 8 || rd.ResponseSize() != 12 || wr.RequestSize() != 20 || wr.ResponseSize() != 4 {
+		t.Errorf("Expected sizes 8/12 and 20/4, generated %v/%v and %v/%v\n",
+			rd.RequestSize(), rd.ResponseSize(), wr.RequestSize(), wr.ResponseSize())
+	}
+}
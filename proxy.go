@@ -0,0 +1,346 @@
+// GoIPbus multiplexing proxy
+
+package goipbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default port of the ControlHub framed clients, as the ControlHub
+const DefaultControlHubPort = 10203
+
+// Error when a chtcp-2.0 client sends something else than a control packet
+var errControlHubRequest = errors.New("IPbus ControlHub request is not a control packet")
+
+// Proxy lets many clients share IPbus targets, as a ControlHub does. The
+// control packets of all the clients of a target are serialised onto a single
+// UDP session, reliable when the target answers status requests: the proxy
+// assigns its own packet and transaction IDs and restores the IDs of each
+// client in the replies.
+//
+// ServeControlHub accepts chtcp-2.0 framed clients, each packet names its
+// target. ServeTCP accepts plain IPbus TCP stream clients, their transactions
+// go to Target one at a time since the stream does not delimit packets.
+type Proxy struct {
+	// Target of the plain IPbus TCP clients, host:port
+	Target string
+	// Timeout bounds the wait for each reply of the targets, DefaultTimeout if zero
+	Timeout time.Duration
+	// ProbeInterval is the least time between two reliability probes of a
+	// target that did not answer the previous one, zero probes it again on
+	// every request
+	ProbeInterval time.Duration
+	// ErrorLog receives the targets falling back to unreliable sessions, the
+	// standard logger if nil
+	ErrorLog *log.Logger
+
+	// serves the stream clients and tracks every listener and connection
+	stream *Server
+
+	mu      sync.Mutex
+	targets map[string]*proxyTarget
+}
+
+// Session with a target, ready is closed once c or err is set
+type proxyTarget struct {
+	ready chan struct{}
+	c     *UDPClient
+	err   error
+
+	// serialises the reliability probes of c
+	mu     sync.Mutex
+	probed time.Time
+	logged bool
+}
+
+// NewProxy returns a proxy whose plain TCP clients use target
+func NewProxy(target string) *Proxy {
+	p := &Proxy{Target: target, targets: make(map[string]*proxyTarget)}
+	p.stream = &Server{Memory: NullMemory{}, handler: p}
+	return p
+}
+
+// ServeTCP accepts plain IPbus TCP clients on l until the proxy is closed
+func (p *Proxy) ServeTCP(l net.Listener) error {
+	return p.stream.ServeTCP(l)
+}
+
+// ServeControlHub accepts chtcp-2.0 clients on l until the proxy is closed
+func (p *Proxy) ServeControlHub(l net.Listener) error {
+	if !p.stream.track(l) {
+		return ErrServerClosed
+	}
+	defer p.stream.untrack(l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if p.stream.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !p.stream.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go p.serveControlHubConn(conn)
+	}
+}
+
+// Close stops all the listeners, disconnects all the clients and closes the
+// sessions with the targets
+func (p *Proxy) Close() error {
+	err := p.stream.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, pt := range p.targets {
+		select {
+		case <-pt.ready:
+			if pt.err == nil {
+				pt.c.Close()
+			}
+		default:
+			// still being opened, target closes it
+		}
+		delete(p.targets, addr)
+	}
+	return err
+}
+
+// Session with the target at addr, opened on first use and made reliable as
+// soon as the target answers a status request. The status probes run without
+// holding p.mu, lookups of the other targets are not delayed by them.
+func (p *Proxy) target(addr string) (*UDPClient, error) {
+	pt, err := p.lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+	p.probe(addr, pt)
+	return pt.c, nil
+}
+
+// Target at addr, dialled on first use
+func (p *Proxy) lookup(addr string) (*proxyTarget, error) {
+	p.mu.Lock()
+	pt, ok := p.targets[addr]
+	if !ok {
+		pt = &proxyTarget{ready: make(chan struct{})}
+		p.targets[addr] = pt
+	}
+	p.mu.Unlock()
+	if ok {
+		<-pt.ready
+		return pt, pt.err
+	}
+
+	c, err := DialUDP(addr)
+	if err == nil {
+		c.Timeout = p.Timeout
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.targets[addr] != pt {
+		// Proxy closed in the meantime
+		if c != nil {
+			c.Close()
+		}
+		c, err = nil, ErrServerClosed
+	} else if err != nil {
+		// Try again on the next lookup
+		delete(p.targets, addr)
+	}
+	pt.c, pt.err = c, err
+	close(pt.ready)
+	return pt, err
+}
+
+// Enable the reliability of the session with pt unless it is already
+// reliable or was probed less than ProbeInterval ago. The first fallback to
+// an unreliable session is logged.
+func (p *Proxy) probe(addr string, pt *proxyTarget) {
+	if pt.c.Session().Reliable() {
+		return
+	}
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if pt.c.Session().Reliable() || (!pt.probed.IsZero() && time.Since(pt.probed) < p.ProbeInterval) {
+		return
+	}
+	pt.probed = time.Now()
+	err := pt.c.EnableReliability()
+	if err != nil && !pt.logged {
+		pt.logged = true
+		p.logf("goipbus: target %v without reliability: %v", addr, err)
+	}
+}
+
+func (p *Proxy) logf(format string, args ...interface{}) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Dispatch the requests of a client to the target at addr and return the
+// responses with the transaction IDs of the client
+func (p *Proxy) forward(addr string, reqs []IPbusRequest) ([]IPbusResponse, error) {
+	c, err := p.target(addr)
+	if err != nil {
+		return nil, err
+	}
+	cp := new(IPbusControlPacket)
+	for i := range reqs {
+		rq := reqs[i]
+		err = cp.Append(&rq)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resps, err := c.Dispatch(cp)
+	// Transaction errors are passed on to the client, any other error means
+	// the reply cannot be trusted
+	var ie *InfoCodeError
+	if err != nil && !errors.As(err, &ie) {
+		return nil, err
+	}
+	if len(resps) != len(reqs) {
+		return nil, errReplyMismatch
+	}
+	for i := range resps {
+		resps[i].id = reqs[i].id
+	}
+	return resps, nil
+}
+
+// Forward a transaction of a plain TCP client to Target
+func (p *Proxy) handleTransaction(req *IPbusRequest) IPbusResponse {
+	resps, err := p.forward(p.Target, []IPbusRequest{*req})
+	if err != nil {
+		return forwardingError(IPbusResponse{id: req.id, words: req.words, typeId: req.typeId}, err)
+	}
+	return resps[0]
+}
+
+// Serve a chtcp-2.0 client until it disconnects or sends a malformed packet
+func (p *Proxy) serveControlHubConn(conn net.Conn) {
+	defer p.stream.untrack(conn)
+	defer conn.Close()
+
+	for {
+		b := make([]byte, 4)
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			return
+		}
+		size := binary.BigEndian.Uint32(b)
+		if size < controlHubRequestHeaderSize || size > maxDatagramSize {
+			return
+		}
+		b = make([]byte, size)
+		_, err = io.ReadFull(conn, b)
+		if err != nil {
+			return
+		}
+		ip := net.IP(append([]byte(nil), b[0:4]...))
+		port := binary.BigEndian.Uint16(b[4:])
+		words := int(binary.BigEndian.Uint16(b[6:]))
+		if controlHubRequestHeaderSize+4*words != len(b) {
+			return
+		}
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+
+		code := ControlHubSuccess
+		reply, err := p.controlHubPacket(addr, b[controlHubRequestHeaderSize:])
+		if err != nil {
+			code = controlHubErrorCode(err)
+			reply = nil
+		}
+
+		out := make([]byte, 4+controlHubReplyHeaderSize, 4+controlHubReplyHeaderSize+len(reply))
+		binary.BigEndian.PutUint32(out[0:], uint32(controlHubReplyHeaderSize+len(reply)))
+		binary.BigEndian.PutUint32(out[4:], uint32(controlHubReplyHeaderSize-4+len(reply)))
+		copy(out[8:], ip.To4())
+		binary.BigEndian.PutUint16(out[12:], port)
+		binary.BigEndian.PutUint16(out[14:], uint16(code))
+		_, err = conn.Write(append(out, reply...))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Forward the control packet of a chtcp-2.0 client and encode the reply in
+// the byte order of the client. Transactions with a bad header are answered
+// by the proxy.
+func (p *Proxy) controlHubPacket(addr string, packet []byte) (reply []byte, err error) {
+	c := &streamClient{input: packet}
+	switch streamState(c) {
+	case IPBUS_ISTREAM_PACKET, IPBUS_ISTREAM_PACKET_SWP_ORD:
+	default:
+		if len(packet) >= 4 && packet[0]>>4 != IPbusProtocolVersion && packet[3]>>4 != IPbusProtocolVersion {
+			return nil, ErrProtocolVersion
+		}
+		return nil, errControlHubRequest
+	}
+	ph := c.word(0)
+	if IPbusPacketHeader(ph).Type() != ControlPacket {
+		return nil, ErrPacketType
+	}
+	c.input = c.input[4:]
+
+	var reqs []IPbusRequest
+	var resps []IPbusResponse
+	// index in resps of the response to each forwarded request
+	var index []int
+	for streamState(c) == IPBUS_ISTREAM_FULL_TRANS {
+		req, size := decodeTransactionStream(c)
+		if size == 0 {
+			resps = append(resps, badHeader(&req))
+			continue
+		}
+		index = append(index, len(resps))
+		resps = append(resps, IPbusResponse{})
+		reqs = append(reqs, req)
+	}
+	if len(reqs) > 0 {
+		forwarded, err := p.forward(addr, reqs)
+		if err != nil {
+			return nil, err
+		}
+		for i, j := range index {
+			resps[j] = forwarded[i]
+		}
+	}
+
+	c.push(ph)
+	for i := range resps {
+		pushResponse(c, &resps[i])
+	}
+	return c.output, nil
+}
+
+// ControlHub error code reporting why a packet was not forwarded
+func controlHubErrorCode(err error) ControlHubErrorCode {
+	var de *DecodeError
+	switch {
+	case errors.Is(err, ErrTimeout), errors.Is(err, ErrPacketLost):
+		return ControlHubTargetTimeout
+	case errors.Is(err, ErrProtocolVersion):
+		return ControlHubProtocolVersion
+	case errors.As(err, &de), errors.Is(err, errReplyMismatch), errors.Is(err, ErrWordCount):
+		return ControlHubMalformedStatus
+	case errors.Is(err, errControlHubRequest), errors.Is(err, ErrPacketType),
+		errors.Is(err, ErrPacketFull), errors.Is(err, ErrTransactionSize):
+		return ControlHubBadRequest
+	}
+	// the target could not be reached
+	return ControlHubTargetTimeout
+}
@@ -0,0 +1,299 @@
+package goipbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Start p for plain TCP and ControlHub clients on the loopback interface
+func testProxy(t *testing.T, p *Proxy) (tcpAddr, chtcpAddr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	ch, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	go p.ServeTCP(l)
+	go p.ServeControlHub(ch)
+	return l.Addr().String(), ch.Addr().String()
+}
+
+func TestProxySharedTarget(t *testing.T) {
+	mem := map[BaseAddress]IPbusWord{0x10: 0x0}
+	// The target only accepts consecutive packet IDs and loses a reply
+	s := &lossyStandIn{dropReply: dropFirst(3, 1)}
+	target, stop := s.serve(t, mem)
+	defer stop()
+
+	p := NewProxy(target)
+	p.Timeout = 50 * time.Millisecond
+	tcpAddr, chtcpAddr := testProxy(t, p)
+	defer p.Close()
+
+	uris := []string{
+		TCPScheme + "://" + tcpAddr,
+		ControlHubScheme + "://" + chtcpAddr + "?target=" + target,
+		ControlHubScheme + "://" + chtcpAddr + "?target=" + target,
+	}
+	const count = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, len(uris))
+	for _, uri := range uris {
+		// Every client numbers its packets from zero
+		c, err := Open(uri)
+		if err != nil {
+			t.Fatalf("Error %v\n", err)
+		}
+		defer c.Close()
+		wg.Add(1)
+		go func(c IPbusClient) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				cp := new(IPbusControlPacket)
+				cp.Append(NewRMWsumRequest(0x10, 0x1))
+				cp.Append(NewReadRequest(0x10, 1))
+				if _, err := c.Dispatch(cp); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Error %v\n", err)
+	}
+	if peek(mem, 0x10) != IPbusWord(len(uris)*count) {
+		t.Errorf("Expected memory %#x, generated %#x\n", len(uris)*count, peek(mem, 0x10))
+	}
+}
+
+func TestProxyTargetTimeout(t *testing.T) {
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer silent.Close()
+
+	p := NewProxy(silent.LocalAddr().String())
+	p.Timeout = 20 * time.Millisecond
+	p.ErrorLog = log.New(io.Discard, "", 0)
+	tcpAddr, chtcpAddr := testProxy(t, p)
+	defer p.Close()
+
+	c, err := DialControlHub(ControlHubScheme + "://" + chtcpAddr + "?target=" + silent.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+	_, err = ReadBlock(c, 0x0, 1)
+	var che *ControlHubError
+	if !errors.As(err, &che) || che.Code != ControlHubTargetTimeout {
+		t.Errorf("Expected ControlHub target timeout, generated %v\n", err)
+	}
+
+	tc, err := DialTCP(tcpAddr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer tc.Close()
+	_, err = ReadBlock(tc, 0x0, 1)
+	if ie, ok := err.(*InfoCodeError); !ok || ie.InfoCode != BusTimeOutOnRead {
+		t.Errorf("Expected bus timeout on read, generated %v\n", err)
+	}
+}
+
+// Writer passing each log line on to a channel
+type logLines chan string
+
+func (l logLines) Write(b []byte) (int, error) {
+	l <- string(b)
+	return len(b), nil
+}
+
+func TestProxyUnreliableTarget(t *testing.T) {
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer silent.Close()
+	mem := map[BaseAddress]IPbusWord{0x10: 0x0}
+	target, stop := new(lossyStandIn).serve(t, mem)
+	defer stop()
+
+	p := NewProxy("")
+	p.Timeout = 200 * time.Millisecond
+	lines := make(logLines, 1)
+	p.ErrorLog = log.New(lines, "", 0)
+	defer p.Close()
+
+	// The status probe of the silent target does not hold up the other one
+	done := make(chan error)
+	go func() {
+		_, err := p.target(silent.LocalAddr().String())
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	if _, err := p.target(target); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if d := time.Since(start); d >= p.Timeout {
+		t.Errorf("Expected a lookup shorter than %v, generated %v\n", p.Timeout, d)
+	}
+
+	// The silent target falls back to an unreliable session and is logged
+	if err := <-done; err != nil {
+		t.Errorf("Expected an unreliable session, generated %v\n", err)
+	}
+	if line := <-lines; !strings.Contains(line, silent.LocalAddr().String()) {
+		t.Errorf("Expected the fallback of %v logged, generated %q\n", silent.LocalAddr(), line)
+	}
+	c, _ := p.target(silent.LocalAddr().String())
+	if c.Session().Reliable() {
+		t.Errorf("Expected an unreliable session\n")
+	}
+}
+
+func TestProxyReliabilityRetry(t *testing.T) {
+	// The first status request is lost
+	probes := 0
+	s := &lossyStandIn{dropStatus: func() bool { probes++; return probes == 1 }}
+	target, stop := s.serve(t, map[BaseAddress]IPbusWord{})
+	defer stop()
+
+	p := NewProxy(target)
+	p.Timeout = 50 * time.Millisecond
+	p.ErrorLog = log.New(io.Discard, "", 0)
+	defer p.Close()
+
+	c, err := p.target(target)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if c.Session().Reliable() {
+		t.Errorf("Expected an unreliable session after the lost probe\n")
+	}
+	// The next request probes the target again
+	if c, err = p.target(target); err != nil || !c.Session().Reliable() {
+		t.Errorf("Expected a reliable session, generated %v\n", err)
+	}
+
+	// Not before ProbeInterval
+	count := 0
+	s = &lossyStandIn{dropStatus: func() bool { count++; return true }}
+	target, stop = s.serve(t, map[BaseAddress]IPbusWord{})
+	defer stop()
+	p.ProbeInterval = time.Hour
+	for i := 0; i < 2; i++ {
+		if c, err = p.target(target); err != nil || c.Session().Reliable() {
+			t.Errorf("Expected an unreliable session, generated %v\n", err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if count != 1 {
+		t.Errorf("Expected a single probe within ProbeInterval, generated %v\n", count)
+	}
+}
+
+func TestProxyMalformedReply(t *testing.T) {
+	target, stop := shortReplyStandIn(t)
+	defer stop()
+	p := NewProxy(target)
+	p.Timeout = 50 * time.Millisecond
+	p.ErrorLog = log.New(io.Discard, "", 0)
+	tcpAddr, _ := testProxy(t, p)
+	defer p.Close()
+
+	// The reply without data is not passed on as a successful read
+	c, err := DialTCP(tcpAddr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+	_, err = ReadBlock(c, 0x0, 1)
+	if ie, ok := err.(*InfoCodeError); !ok || ie.InfoCode != BusErrorOnRead {
+		t.Errorf("Expected bus error on read, generated %v\n", err)
+	}
+}
+
+// Send the words to target through the chtcp-2.0 proxy at chtcpAddr, returns
+// the error code of the reply
+func controlHubExchange(t *testing.T, chtcpAddr, target string, words ...uint32) ControlHubErrorCode {
+	conn, err := net.Dial("tcp", chtcpAddr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer conn.Close()
+	ua, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	b := make([]byte, 4+controlHubRequestHeaderSize)
+	binary.BigEndian.PutUint32(b, uint32(controlHubRequestHeaderSize+4*len(words)))
+	copy(b[4:], ua.IP.To4())
+	binary.BigEndian.PutUint16(b[8:], uint16(ua.Port))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(words)))
+	if _, err := conn.Write(append(b, wordBytes(words...)...)); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	reply := make([]byte, 4+controlHubReplyHeaderSize)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	return ControlHubErrorCode(binary.BigEndian.Uint16(reply[14:]))
+}
+
+func TestProxyControlHubErrors(t *testing.T) {
+	target, stop := new(lossyStandIn).serve(t, map[BaseAddress]IPbusWord{})
+	defer stop()
+	p := NewProxy(target)
+	p.ErrorLog = log.New(io.Discard, "", 0)
+	_, chtcpAddr := testProxy(t, p)
+	defer p.Close()
+
+	// Replies of 255 words to 8 reads do not fit in a packet
+	var full []uint32
+	for i := 0; i < 8; i++ {
+		full = append(full, 0x2000ff0f|uint32(i)<<16, 0x0)
+	}
+	for _, test := range []struct {
+		name  string
+		words []uint32
+		code  ControlHubErrorCode
+	}{
+		{"control", []uint32{0x200000f0, 0x2000010f, 0x0}, ControlHubSuccess},
+		{"status", []uint32{0x200000f1}, ControlHubBadRequest},
+		{"version", []uint32{0x100000f0}, ControlHubProtocolVersion},
+		{"packet full", append([]uint32{0x200000f0}, full...), ControlHubBadRequest},
+	} {
+		if code := controlHubExchange(t, chtcpAddr, target, test.words...); code != test.code {
+			t.Errorf("%s: Expected %v, generated %v\n", test.name, test.code, code)
+		}
+	}
+
+	for _, test := range []struct {
+		err  error
+		code ControlHubErrorCode
+	}{
+		{&TimeoutError{ID: 1, Lost: ErrReplyLost}, ControlHubTargetTimeout},
+		{&DecodeError{Offset: 4, Err: ErrWordCount}, ControlHubMalformedStatus},
+		{&DecodeError{Offset: 0, Err: ErrProtocolVersion}, ControlHubProtocolVersion},
+		{errReplyMismatch, ControlHubMalformedStatus},
+	} {
+		if code := controlHubErrorCode(test.err); code != test.code {
+			t.Errorf("Expected %v for %v, generated %v\n", test.code, test.err, code)
+		}
+	}
+}
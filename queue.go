@@ -0,0 +1,183 @@
+// GoIPbus device transaction queue
+
+package goipbus
+
+import (
+	"context"
+	"errors"
+)
+
+// ValWord is the value of a queued read, valid once the queue has been
+// dispatched and the reply received
+type ValWord struct {
+	value IPbusWord
+	valid bool
+}
+
+// Valid reports whether the read has been answered successfully
+func (v *ValWord) Valid() bool {
+	return v.valid
+}
+
+// Value returns the word read, zero until Valid
+func (v *ValWord) Value() IPbusWord {
+	return v.value
+}
+
+// ValVector is the value of a queued block read, valid once the queue has
+// been dispatched and all the replies received
+type ValVector struct {
+	value []IPbusWord
+	valid bool
+	// a transaction of the block was not handled successfully
+	failed bool
+}
+
+// Valid reports whether the whole block has been answered successfully
+func (v *ValVector) Valid() bool {
+	return v.valid
+}
+
+// Value returns the words read, nil until Valid
+func (v *ValVector) Value() []IPbusWord {
+	if !v.valid {
+		return nil
+	}
+	return v.value
+}
+
+// A request waiting in the queue of a device and the handle its response
+// fills, if any
+type queuedRequest struct {
+	req    *IPbusRequest
+	word   *ValWord
+	vector *ValVector
+	// last request of a block, the vector is complete with its response
+	last bool
+}
+
+// Store the response data into the handle, a handle whose response is not
+// successful stays invalid
+func (q *queuedRequest) fill(resp *IPbusResponse) {
+	ok := resp.infoCode == RequestHandledSuccesfully
+	switch {
+	case q.word != nil:
+		if ok && len(resp.data) > 0 {
+			q.word.value = resp.data[0]
+			q.word.valid = true
+		}
+	case q.vector != nil:
+		if !ok {
+			q.vector.failed = true
+		}
+		q.vector.value = append(q.vector.value, resp.data...)
+		q.vector.valid = q.last && !q.vector.failed
+	}
+}
+
+func (d *Device) enqueue(q ...queuedRequest) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queue = append(d.queue, q...)
+}
+
+// Queue a block of requests whose data is collected by vector. An empty
+// block has nothing to wait for, its vector is valid at once.
+func (d *Device) enqueueBlock(reqs []*IPbusRequest, vector *ValVector) {
+	if len(reqs) == 0 {
+		if vector != nil {
+			vector.valid = true
+		}
+		return
+	}
+	q := make([]queuedRequest, len(reqs))
+	for i, rq := range reqs {
+		q[i] = queuedRequest{req: rq, vector: vector, last: i == len(reqs)-1}
+	}
+	d.enqueue(q...)
+}
+
+// Read queues a read of the word at addr, the handle is filled by Dispatch
+func (d *Device) Read(addr BaseAddress) *ValWord {
+	v := new(ValWord)
+	d.enqueue(queuedRequest{req: NewReadRequest(addr, 1), word: v})
+	return v
+}
+
+// Write queues a write of v at addr
+func (d *Device) Write(addr BaseAddress, v IPbusWord) {
+	d.enqueue(queuedRequest{req: NewWriteRequest(addr, []IPbusWord{v})})
+}
+
+// ReadBlock queues a read of size words starting at addr, the handle is
+// filled by Dispatch. A negative size is rejected with ErrBlockSize.
+func (d *Device) ReadBlock(addr BaseAddress, size int) (*ValVector, error) {
+	if size < 0 {
+		return nil, ErrBlockSize
+	}
+	v := &ValVector{value: make([]IPbusWord, 0, size)}
+	d.enqueueBlock(NewBlockReadRequests(addr, size), v)
+	return v, nil
+}
+
+// NonIncrementalReadBlock queues size reads of the FIFO at addr
+func (d *Device) NonIncrementalReadBlock(addr BaseAddress, size int) (*ValVector, error) {
+	if size < 0 {
+		return nil, ErrBlockSize
+	}
+	v := &ValVector{value: make([]IPbusWord, 0, size)}
+	d.enqueueBlock(NewBlockNonIncrementalReadRequests(addr, size), v)
+	return v, nil
+}
+
+// WriteBlock queues a write of data starting at addr
+func (d *Device) WriteBlock(addr BaseAddress, data []IPbusWord) {
+	d.enqueueBlock(NewBlockWriteRequests(addr, data), nil)
+}
+
+// NonIncrementalWriteBlock queues the data pushed into the FIFO at addr
+func (d *Device) NonIncrementalWriteBlock(addr BaseAddress, data []IPbusWord) {
+	d.enqueueBlock(NewBlockNonIncrementalWriteRequests(addr, data), nil)
+}
+
+// Dispatch packs the queued transactions, in order, into as few control
+// packets as possible and sends them. The handles of each packet are filled
+// once its reply is received. When a transaction is not handled successfully
+// the other handles of its packet are still filled and its *InfoCodeError is
+// returned; the handles of the packets not sent stay invalid. The queue is
+// empty when Dispatch returns.
+func (d *Device) Dispatch(ctx context.Context) error {
+	d.mu.Lock()
+	queue := d.queue
+	d.queue = nil
+	d.mu.Unlock()
+
+	reqs := make([]*IPbusRequest, len(queue))
+	for i := range queue {
+		reqs[i] = queue[i].req
+	}
+	cps, err := PackRequests(reqs)
+	if err != nil {
+		return err
+	}
+	for _, cp := range cps {
+		err = contextDone(ctx)
+		if err != nil {
+			return err
+		}
+		resps, err := d.client.DispatchContext(ctx, cp)
+		var ie *InfoCodeError
+		if err != nil && !errors.As(err, &ie) {
+			return err
+		}
+		// an *InfoCodeError comes with the whole reply of the packet
+		for i := range resps {
+			queue[0].fill(&resps[i])
+			queue = queue[1:]
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package goipbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestDeviceQueue(t *testing.T) {
+	d, srv, rc := testDevice(t)
+	defer srv.Close()
+	defer d.Close()
+
+	d.Write(0x10, 0xa)
+	d.WriteBlock(0x20, []IPbusWord{0x1, 0x2, 0x3})
+	w := d.Read(0x10)
+	v, _ := d.ReadBlock(0x20, 3)
+	if w.Valid() || v.Valid() || v.Value() != nil {
+		t.Errorf("Expected invalid handles before Dispatch\n")
+	}
+	if rc.packets != 0 {
+		t.Errorf("Expected nothing sent before Dispatch, generated %v packets\n", rc.packets)
+	}
+	if err := d.Dispatch(context.Background()); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if rc.packets != 1 {
+		t.Errorf("Expected 1 packet, generated %v\n", rc.packets)
+	}
+	if !w.Valid() || w.Value() != 0xa {
+		t.Errorf("Expected valid 0xa, generated %v %#x\n", w.Valid(), w.Value())
+	}
+	if d := v.Value(); !v.Valid() || len(d) != 3 || d[0] != 0x1 || d[2] != 0x3 {
+		t.Errorf("Expected valid 0x1 0x2 0x3, generated %v %#x\n", v.Valid(), d)
+	}
+
+	// A large queue is spread over the minimum number of packets
+	rc.packets = 0
+	data := make([]IPbusWord, 600)
+	for i := range data {
+		data[i] = IPbusWord(i)
+	}
+	d.WriteBlock(0x100, data)
+	v, _ = d.ReadBlock(0x100, len(data))
+	var reqs []*IPbusRequest
+	reqs = append(reqs, NewBlockWriteRequests(0x100, data)...)
+	reqs = append(reqs, NewBlockReadRequests(0x100, len(data))...)
+	cps, _ := PackRequests(reqs)
+	if err := d.Dispatch(context.Background()); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if rc.packets != len(cps) || len(cps) >= len(reqs) {
+		t.Errorf("Expected %v packets, generated %v\n", len(cps), rc.packets)
+	}
+	if len(v.Value()) != len(data) || v.Value()[599] != 599 {
+		t.Errorf("Expected %v words, generated %v\n", len(data), len(v.Value()))
+	}
+}
+
+func TestDeviceQueueError(t *testing.T) {
+	d, srv, _ := testDevice(t)
+	defer srv.Close()
+	defer d.Close()
+
+	d.Write(0x10, 0xa)
+	if err := d.Dispatch(context.Background()); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	// Only the handles of the failed transactions are invalid
+	w := d.Read(0x10)
+	bad := d.Read(0x10000)
+	v, _ := d.ReadBlock(0xf00, 0x200)
+	empty, err := d.ReadBlock(0x10, 0)
+	if err != nil || !empty.Valid() || len(empty.Value()) != 0 {
+		t.Errorf("Expected valid empty block before dispatch, generated %v (%v)\n", empty, err)
+	}
+	// Negative sizes are rejected, nothing is queued
+	if v, err := d.ReadBlock(0x10, -1); err != ErrBlockSize || v != nil {
+		t.Errorf("Expected %v, generated %v\n", ErrBlockSize, err)
+	}
+	if v, err := d.NonIncrementalReadBlock(0x10, -1); err != ErrBlockSize || v != nil {
+		t.Errorf("Expected %v, generated %v\n", ErrBlockSize, err)
+	}
+	err = d.Dispatch(context.Background())
+	if ie, ok := err.(*InfoCodeError); !ok || ie.InfoCode != BusErrorOnRead {
+		t.Errorf("Expected bus error on read, generated %v\n", err)
+	}
+	if !w.Valid() || w.Value() != 0xa {
+		t.Errorf("Expected valid 0xa, generated %v %#x\n", w.Valid(), w.Value())
+	}
+	if bad.Valid() || v.Valid() || v.Value() != nil {
+		t.Errorf("Expected invalid handles for the bus errors\n")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = d.Read(0x10)
+	if err := d.Dispatch(ctx); err != context.Canceled || w.Valid() {
+		t.Errorf("Expected context.Canceled, generated %v\n", err)
+	}
+	// The queue is emptied by every dispatch
+	if err := d.Dispatch(context.Background()); err != nil {
+		t.Errorf("Expected empty queue, generated %v\n", err)
+	}
+}
+
+// UDP target answering every transaction successfully with Words=0 and no
+// payload
+func shortReplyStandIn(t *testing.T) (addr string, stop func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	go func() {
+		b := make([]byte, maxDatagramSize)
+		for {
+			n, raddr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			word := make([]uint32, n/4)
+			binary.Read(bytes.NewReader(b[:n]), binary.BigEndian, word)
+			out := []uint32{word[0]}
+			for i := 1; i < len(word); i += standInRequestSize(word[i]) {
+				out = append(out, word[i]&^0xff0f)
+			}
+			buf := new(bytes.Buffer)
+			binary.Write(buf, binary.BigEndian, out)
+			conn.WriteToUDP(buf.Bytes(), raddr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func TestDeviceShortReply(t *testing.T) {
+	addr, stop := shortReplyStandIn(t)
+	defer stop()
+	c, err := DialUDP(addr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	table, err := LoadAddressTable("cactuscore/softipbus/etc/test_address.xml")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	d := NewDevice(c, table)
+	defer d.Close()
+
+	w := d.Read(0x10)
+	v, _ := d.ReadBlock(0x10, 2)
+	if err := d.Dispatch(context.Background()); err != ErrWordCount {
+		t.Errorf("Expected %v, generated %v\n", ErrWordCount, err)
+	}
+	if w.Valid() || v.Valid() {
+		t.Errorf("Expected invalid handles after a short reply\n")
+	}
+
+	reg, err := d.GetNode("REG")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if _, err := reg.Read(); err != ErrWordCount {
+		t.Errorf("Expected %v, generated %v\n", ErrWordCount, err)
+	}
+	// the decoder already rejects a RMW response without its word
+	if _, err := d.RMWSum(0x10, 1); !errors.Is(err, ErrWordCount) {
+		t.Errorf("Expected %v, generated %v\n", ErrWordCount, err)
+	}
+}
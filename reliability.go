@@ -0,0 +1,245 @@
+// GoIPbus reliability mechanism
+
+package goipbus
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Size in bytes of a status request or reply
+const statusPacketSize = 64
+
+// Number of recovery attempts after a timeout, when Retries is zero
+const DefaultRetries = 3
+
+// Error when a timed out packet can no longer be recovered from the target
+var ErrPacketLost = errors.New("IPbus control packet lost")
+
+// Ways a timed out control packet is lost, as told by the target status
+var ErrRequestLost = errors.New("IPbus request lost")
+var ErrReplyLost = errors.New("IPbus reply lost")
+
+// TimeoutError reports a control packet of a reliable session whose reply
+// could not be recovered. Lost is ErrRequestLost or ErrReplyLost, as found
+// by the last recovery attempt. It matches both ErrTimeout and Lost with
+// errors.Is.
+type TimeoutError struct {
+	ID   IPbusPacketID
+	Lost error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%v: packet %#x, %v", ErrTimeout, e.ID, e.Lost)
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout || target == e.Lost
+}
+
+// NewStatusRequest returns a status request packet: the packet header
+// followed by 15 zero words.
+func NewStatusRequest() *IPbusStatusPacket {
+	sp := new(IPbusStatusPacket)
+	sp[0] = int32(IPbusProtocolVersion<<28 | uint32(BigEndian)<<4 | uint32(StatusPacket))
+	return sp
+}
+
+// Encode the status packet into b, returns the number of bytes written
+func (sp *IPbusStatusPacket) Encode(b []byte) (n int, err error) {
+	if len(b) < statusPacketSize {
+		return 0, ErrShortBuffer
+	}
+	for i, v := range sp {
+		binary.BigEndian.PutUint32(b[4*i:], uint32(v))
+	}
+	return statusPacketSize, nil
+}
+
+// Decode a status reply from b. Malformed replies are reported as a
+// *DecodeError.
+func (sp *IPbusStatusPacket) Decode(b []byte) error {
+	if len(b) < statusPacketSize {
+		return &DecodeError{Offset: len(b), Err: ErrUnexpectedEOF}
+	}
+	ph := IPbusPacketHeader(binary.BigEndian.Uint32(b))
+	switch {
+	case ph.Version() != IPbusProtocolVersion:
+		return &DecodeError{Offset: 0, Err: ErrProtocolVersion}
+	case ph.ByteOrder() != BigEndian:
+		return &DecodeError{Offset: 0, Err: ErrByteOrder}
+	case ph.Type() != StatusPacket:
+		return &DecodeError{Offset: 0, Err: ErrPacketType}
+	}
+	for i := range sp {
+		sp[i] = int32(binary.BigEndian.Uint32(b[4*i:]))
+	}
+	return nil
+}
+
+// Header returns the packet header of the status packet
+func (sp *IPbusStatusPacket) Header() IPbusPacketHeader {
+	return IPbusPacketHeader(uint32(sp[0]))
+}
+
+// MTU returns the largest packet in bytes the target can receive
+func (sp *IPbusStatusPacket) MTU() uint32 {
+	return uint32(sp[1])
+}
+
+// Buffers returns the number of reply buffers of the target
+func (sp *IPbusStatusPacket) Buffers() uint32 {
+	return uint32(sp[2])
+}
+
+// NextPacketID returns the ID of the next control packet expected by the
+// target
+func (sp *IPbusStatusPacket) NextPacketID() IPbusPacketID {
+	return IPbusPacketHeader(uint32(sp[3])).ID()
+}
+
+// TrafficHistory returns one byte per packet recently received by the target,
+// most recent first
+func (sp *IPbusStatusPacket) TrafficHistory() (h [16]uint8) {
+	for i := 0; i < 4; i++ {
+		binary.BigEndian.PutUint32(h[4*i:], uint32(sp[4+i]))
+	}
+	return h
+}
+
+// ReceivedHeaders returns the headers of the last control packets received by
+// the target, most recent first
+func (sp *IPbusStatusPacket) ReceivedHeaders() (h [4]IPbusPacketHeader) {
+	for i := range h {
+		h[i] = IPbusPacketHeader(uint32(sp[8+i]))
+	}
+	return h
+}
+
+// SentHeaders returns the headers of the last control packets sent by the
+// target, most recent first
+func (sp *IPbusStatusPacket) SentHeaders() (h [4]IPbusPacketHeader) {
+	for i := range h {
+		h[i] = IPbusPacketHeader(uint32(sp[12+i]))
+	}
+	return h
+}
+
+// Whether the target still holds the reply with packet header ph
+func (sp *IPbusStatusPacket) sent(ph IPbusPacketHeader) bool {
+	for _, h := range sp.SentHeaders() {
+		if h == ph {
+			return true
+		}
+	}
+	return false
+}
+
+// NewResendRequest returns a request to re-send the control packet reply with
+// the given packet ID
+func NewResendRequest(id IPbusPacketID) IPbusResendPacket {
+	return IPbusResendPacket(int32(IPbusProtocolVersion<<28 | uint32(id)<<8 | uint32(BigEndian)<<4 | uint32(RequestPacket)))
+}
+
+// ID returns the packet ID of the reply to be re-sent
+func (rp IPbusResendPacket) ID() IPbusPacketID {
+	return IPbusPacketHeader(uint32(rp)).ID()
+}
+
+// Encode the re-send request into b, returns the number of bytes written
+func (rp IPbusResendPacket) Encode(b []byte) (n int, err error) {
+	if len(b) < 4 {
+		return 0, ErrShortBuffer
+	}
+	binary.BigEndian.PutUint32(b, uint32(rp))
+	return 4, nil
+}
+
+// Status sends a status request to the target and returns its reply
+func (c *UDPClient) Status() (*IPbusStatusPacket, error) {
+	return c.StatusContext(context.Background())
+}
+
+// StatusContext is Status aborted when ctx is done
+func (c *UDPClient) StatusContext(ctx context.Context) (*IPbusStatusPacket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stop := watchContext(ctx, c.conn.SetReadDeadline)
+	defer stop()
+	return c.status(ctx)
+}
+
+func (c *UDPClient) status(ctx context.Context) (*IPbusStatusPacket, error) {
+	sp := NewStatusRequest()
+	b := make([]byte, statusPacketSize)
+	n, err := sp.Encode(b)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.conn.Write(b[:n])
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.receive(ctx, sp.Header())
+	if err != nil {
+		return nil, err
+	}
+	err = sp.Decode(reply)
+	if err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// EnableReliability queries the status of the target and continues the
+// session from the packet ID it expects next. Later timeouts are then
+// recovered by retransmitting lost requests or asking the target to re-send
+// lost replies.
+func (c *UDPClient) EnableReliability() error {
+	return c.EnableReliabilityContext(context.Background())
+}
+
+// EnableReliabilityContext is EnableReliability aborted when ctx is done
+func (c *UDPClient) EnableReliabilityContext(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stop := watchContext(ctx, c.conn.SetReadDeadline)
+	defer stop()
+	sp, err := c.status(ctx)
+	if err != nil {
+		return err
+	}
+	c.session.enableReliability(sp.NextPacketID())
+	return nil
+}
+
+// Recover the reply to request b, with packet header ph, after a timeout. The
+// target status tells whether the request or the reply was lost, lost is
+// ErrRequestLost or ErrReplyLost accordingly.
+func (c *UDPClient) recover(ctx context.Context, ph IPbusPacketHeader, b []byte) (reply []byte, lost, err error) {
+	sp, err := c.status(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case sp.NextPacketID() == ph.ID():
+		// Request lost, send it again
+		lost = ErrRequestLost
+		_, err = c.conn.Write(b)
+	case sp.sent(ph):
+		// Reply lost, ask the target for it
+		lost = ErrReplyLost
+		rb := make([]byte, 4)
+		n, _ := NewResendRequest(ph.ID()).Encode(rb)
+		_, err = c.conn.Write(rb[:n])
+	default:
+		return nil, nil, ErrPacketLost
+	}
+	if err != nil {
+		return nil, lost, err
+	}
+	reply, err = c.receive(ctx, ph)
+	return reply, lost, err
+}
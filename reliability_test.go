@@ -0,0 +1,346 @@
+package goipbus
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// UDP target implementing the reliability mechanism. dropRequest and
+// dropReply are called with the ID of every control packet and decide
+// whether it is lost on the way in or out, dropStatus whether a status
+// request is ignored.
+type lossyStandIn struct {
+	mu          sync.Mutex
+	next        IPbusPacketID
+	received    []uint32
+	sent        [][]byte
+	dropRequest func(id IPbusPacketID) bool
+	dropReply   func(id IPbusPacketID) bool
+	dropStatus  func() bool
+}
+
+func (s *lossyStandIn) serve(t *testing.T, mem map[BaseAddress]IPbusWord) (addr string, stop func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	s.next = 1
+	go func() {
+		b := make([]byte, maxDatagramSize)
+		for {
+			n, raddr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			if reply := s.handle(b[:n], mem); reply != nil {
+				conn.WriteToUDP(reply, raddr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+// Process one request packet, returns the datagram to send back if any
+func (s *lossyStandIn) handle(b []byte, mem map[BaseAddress]IPbusWord) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ph := IPbusPacketHeader(binary.BigEndian.Uint32(b))
+	switch ph.Type() {
+	case StatusPacket:
+		if s.dropStatus != nil && s.dropStatus() {
+			return nil
+		}
+		reply := make([]byte, statusPacketSize)
+		word := []uint32{uint32(ph), 1500, 4, 0x200000f0 | uint32(s.next)<<8}
+		for i, v := range word {
+			binary.BigEndian.PutUint32(reply[4*i:], v)
+		}
+		for i := 0; i < 4 && i < len(s.received); i++ {
+			binary.BigEndian.PutUint32(reply[32+4*i:], s.received[len(s.received)-1-i])
+		}
+		for i := 0; i < 4 && i < len(s.sent); i++ {
+			copy(reply[48+4*i:], s.sent[len(s.sent)-1-i][:4])
+		}
+		return reply
+	case RequestPacket:
+		for _, r := range s.sent {
+			if IPbusPacketHeader(binary.BigEndian.Uint32(r)).ID() == ph.ID() {
+				return s.out(r)
+			}
+		}
+		return nil
+	}
+	if s.dropRequest != nil && s.dropRequest(ph.ID()) {
+		return nil
+	}
+	// Packet ID 0x0 is always accepted, outside the reliability mechanism
+	if ph.ID() == 0 {
+		return s.out(standInReply(b, mem))
+	}
+	if ph.ID() != s.next {
+		return nil
+	}
+	s.next++
+	if s.next == 0 {
+		s.next = 1
+	}
+	s.received = append(s.received, uint32(ph))
+	reply := standInReply(b, mem)
+	s.sent = append(s.sent, reply)
+	return s.out(reply)
+}
+
+func (s *lossyStandIn) out(reply []byte) []byte {
+	id := IPbusPacketHeader(binary.BigEndian.Uint32(reply)).ID()
+	if s.dropReply != nil && s.dropReply(id) {
+		return nil
+	}
+	return reply
+}
+
+// Drop the first n packets with the given ID
+func dropFirst(id IPbusPacketID, n int) func(IPbusPacketID) bool {
+	count := 0
+	return func(i IPbusPacketID) bool {
+		if i != id || count >= n {
+			return false
+		}
+		count++
+		return true
+	}
+}
+
+func dialReliable(t *testing.T, addr string) *UDPClient {
+	c, err := DialUDP(addr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	c.Timeout = 50 * time.Millisecond
+	err = c.EnableReliability()
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	return c
+}
+
+func TestStatusPacket(t *testing.T) {
+	b := make([]byte, statusPacketSize)
+	n, err := NewStatusRequest().Encode(b)
+	if err != nil || n != statusPacketSize || binary.BigEndian.Uint32(b) != 0x200000f1 {
+		t.Errorf("Expected status request 0x200000f1, generated %#x %v\n", b[:4], err)
+	}
+	for _, v := range b[4:] {
+		if v != 0 {
+			t.Fatalf("Expected zero status request body, generated %#x\n", b)
+		}
+	}
+
+	word := []uint32{0x200000f1, 1472, 2, 0x200005f0,
+		0x0102030f, 0, 0, 0,
+		0x200004f0, 0x200003f0, 0, 0,
+		0x200004f0, 0x200003f0, 0, 0}
+	for i, v := range word {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	var sp IPbusStatusPacket
+	err = sp.Decode(b)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if sp.MTU() != 1472 || sp.Buffers() != 2 || sp.NextPacketID() != 5 {
+		t.Errorf("Expected MTU 1472, 2 buffers, next ID 5, generated %v %v %v\n", sp.MTU(), sp.Buffers(), sp.NextPacketID())
+	}
+	if h := sp.TrafficHistory(); h[0] != 0x01 || h[3] != 0x0f {
+		t.Errorf("Expected traffic history 01 02 03 0f, generated %#x\n", h)
+	}
+	if h := sp.ReceivedHeaders(); h[0] != 0x200004f0 || h[1] != 0x200003f0 {
+		t.Errorf("Expected received headers 0x200004f0 0x200003f0, generated %#x\n", h)
+	}
+	if !sp.sent(0x200003f0) || sp.sent(0x200005f0) {
+		t.Errorf("Expected sent headers 0x200004f0 0x200003f0, generated %#x\n", sp.SentHeaders())
+	}
+
+	err = sp.Decode(b[:60])
+	if de, ok := err.(*DecodeError); !ok || de.Err != ErrUnexpectedEOF {
+		t.Errorf("Expected %v, generated %v\n", ErrUnexpectedEOF, err)
+	}
+	binary.BigEndian.PutUint32(b, 0x200000f0)
+	err = sp.Decode(b)
+	if de, ok := err.(*DecodeError); !ok || de.Err != ErrPacketType {
+		t.Errorf("Expected %v, generated %v\n", ErrPacketType, err)
+	}
+}
+
+func TestResendPacket(t *testing.T) {
+	rp := NewResendRequest(0x1234)
+	b := make([]byte, 4)
+	n, err := rp.Encode(b)
+	if err != nil || n != 4 || binary.BigEndian.Uint32(b) != 0x201234f2 {
+		t.Errorf("Expected resend request 0x201234f2, generated %#x %v\n", b, err)
+	}
+	if rp.ID() != 0x1234 {
+		t.Errorf("Expected ID 0x1234, generated %#x\n", rp.ID())
+	}
+}
+
+func TestReliablePacketIDWrap(t *testing.T) {
+	s := NewSession()
+	s.enableReliability(0xffff)
+	s.mu.Lock()
+	s.increasePacketID()
+	s.mu.Unlock()
+	if s.PacketID() != 1 {
+		t.Errorf("Expected packet ID 1 after wrap, generated %v\n", s.PacketID())
+	}
+}
+
+func TestReliabilityLostRequest(t *testing.T) {
+	mem := map[BaseAddress]IPbusWord{0x10: 0x1}
+	s := &lossyStandIn{dropRequest: dropFirst(1, 1)}
+	addr, stop := s.serve(t, mem)
+	defer stop()
+	c := dialReliable(t, addr)
+	defer c.Close()
+
+	cp := new(IPbusControlPacket)
+	cp.Append(NewRMWsumRequest(0x10, 0x1))
+	resps, err := c.Dispatch(cp)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if d := resps[0].Data(); len(d) != 1 || d[0] != 0x1 || peek(mem, 0x10) != 0x2 {
+		t.Errorf("Expected RMWsum 0x1 -> 0x2, generated %#x -> %#x\n", d, peek(mem, 0x10))
+	}
+}
+
+func TestReliabilityLostReply(t *testing.T) {
+	mem := map[BaseAddress]IPbusWord{0x10: 0x1}
+	s := &lossyStandIn{dropReply: dropFirst(2, 2)}
+	addr, stop := s.serve(t, mem)
+	defer stop()
+	c := dialReliable(t, addr)
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		cp := new(IPbusControlPacket)
+		cp.Append(NewRMWsumRequest(0x10, 0x1))
+		resps, err := c.Dispatch(cp)
+		if err != nil {
+			t.Fatalf("Error %v\n", err)
+		}
+		// The lost reply is re-sent, not executed again
+		if d := resps[0].Data(); len(d) != 1 || d[0] != IPbusWord(i+1) {
+			t.Errorf("Expected RMWsum old value %#x, generated %#x\n", i+1, d)
+		}
+	}
+	if peek(mem, 0x10) != 0x4 {
+		t.Errorf("Expected memory 0x4, generated %#x\n", peek(mem, 0x10))
+	}
+}
+
+func TestReliabilityTimeout(t *testing.T) {
+	s := &lossyStandIn{dropRequest: func(IPbusPacketID) bool { return true }}
+	addr, stop := s.serve(t, map[BaseAddress]IPbusWord{})
+	defer stop()
+	c := dialReliable(t, addr)
+	defer c.Close()
+	c.Retries = 2
+
+	cp := new(IPbusControlPacket)
+	cp.Append(NewReadRequest(0x10, 1))
+	_, err := c.Dispatch(cp)
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, ErrRequestLost) {
+		t.Errorf("Expected %v with %v, generated %v\n", ErrTimeout, ErrRequestLost, err)
+	}
+}
+
+func TestReliabilityReplyLostTimeout(t *testing.T) {
+	s := &lossyStandIn{dropReply: func(IPbusPacketID) bool { return true }}
+	addr, stop := s.serve(t, map[BaseAddress]IPbusWord{})
+	defer stop()
+	c := dialReliable(t, addr)
+	defer c.Close()
+	c.Retries = 2
+
+	cp := new(IPbusControlPacket)
+	cp.Append(NewReadRequest(0x10, 1))
+	_, err := c.Dispatch(cp)
+	var te *TimeoutError
+	if !errors.As(err, &te) || te.Lost != ErrReplyLost || te.ID != 1 || !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected %v with %v, generated %v\n", ErrTimeout, ErrReplyLost, err)
+	}
+}
+
+func TestReliabilityContext(t *testing.T) {
+	s := &lossyStandIn{dropRequest: func(IPbusPacketID) bool { return true }}
+	addr, stop := s.serve(t, map[BaseAddress]IPbusWord{})
+	defer stop()
+	c, err := DialUDP(addr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+	c.Timeout = time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.EnableReliabilityContext(ctx); err != context.Canceled || c.Session().Reliable() {
+		t.Errorf("Expected %v, generated %v\n", context.Canceled, err)
+	}
+	if err := c.EnableReliabilityContext(context.Background()); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+
+	// A deadline shorter than Timeout expires before any recovery
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	cp := new(IPbusControlPacket)
+	cp.Append(NewReadRequest(0x10, 1))
+	start := time.Now()
+	_, err = c.DispatchContext(ctx, cp)
+	var te *TimeoutError
+	if err != context.DeadlineExceeded || errors.As(err, &te) {
+		t.Errorf("Expected %v, generated %v\n", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d >= c.Timeout {
+		t.Errorf("Expected a dispatch shorter than %v, generated %v\n", c.Timeout, d)
+	}
+}
+
+func TestReliabilityMixedTraffic(t *testing.T) {
+	mem := map[BaseAddress]IPbusWord{0x10: 0x0}
+	s := new(lossyStandIn)
+	addr, stop := s.serve(t, mem)
+	defer stop()
+	plain, err := DialUDP(addr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer plain.Close()
+	plain.Timeout = 50 * time.Millisecond
+	reliable := dialReliable(t, addr)
+	defer reliable.Close()
+
+	// The non-reliable packets do not disturb the reliable sequence
+	for i := 0; i < 3; i++ {
+		for _, c := range []*UDPClient{plain, plain, reliable} {
+			cp := new(IPbusControlPacket)
+			cp.Append(NewRMWsumRequest(0x10, 0x1))
+			if _, err := c.Dispatch(cp); err != nil {
+				t.Fatalf("Error %v\n", err)
+			}
+		}
+	}
+	if peek(mem, 0x10) != 9 {
+		t.Errorf("Expected memory 0x9, generated %#x\n", peek(mem, 0x10))
+	}
+	sp, err := reliable.Status()
+	if err != nil || sp.NextPacketID() != 4 || reliable.Session().PacketID() != 4 {
+		t.Errorf("Expected next packet ID 4, generated %v (%v)\n", reliable.Session().PacketID(), err)
+	}
+}
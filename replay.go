@@ -0,0 +1,75 @@
+// GoIPbus reply buffers, the target side of the UDP reliability mechanism
+
+package goipbus
+
+// Number of control packet replies a UDP target keeps to be re-sent
+const replayBuffers = 4
+
+// replayBuffer tracks the control packets received on one UDP socket of a
+// Server: the packet ID expected next and the last replies sent, re-sent on
+// request. Packets with ID 0x0 are always served and never recorded.
+type replayBuffer struct {
+	// Next packet ID expected, 0x0 until the first packet
+	next IPbusPacketID
+	// Last replies sent and their packet headers, oldest first. The headers
+	// are also those of the last control packets received.
+	sent    [][]byte
+	headers []IPbusPacketHeader
+}
+
+func (r *replayBuffer) nextID() IPbusPacketID {
+	if r.next == 0 {
+		return 1
+	}
+	return r.next
+}
+
+// Whether the control packet with header ph is to be served, false for the
+// non-zero IDs out of sequence
+func (r *replayBuffer) accept(ph IPbusPacketHeader) bool {
+	return ph.ID() == 0 || ph.ID() == r.nextID()
+}
+
+// Record the reply to the control packet with header ph
+func (r *replayBuffer) record(ph IPbusPacketHeader, reply []byte) {
+	if ph.ID() == 0 {
+		return
+	}
+	r.next = r.nextID() + 1
+	if r.next == 0 {
+		r.next = 1
+	}
+	r.sent = append(r.sent, append([]byte(nil), reply...))
+	r.headers = append(r.headers, ph)
+	if len(r.sent) > replayBuffers {
+		r.sent = r.sent[1:]
+		r.headers = r.headers[1:]
+	}
+}
+
+// Reply to a status request with header ph
+func (r *replayBuffer) status(ph IPbusPacketHeader) []byte {
+	sp := new(IPbusStatusPacket)
+	sp[0] = int32(ph)
+	sp[1] = int32(maxRequestSize)
+	sp[2] = replayBuffers
+	sp[3] = int32(IPbusProtocolVersion<<28 | uint32(r.nextID())<<8 | uint32(BigEndian)<<4 | uint32(ControlPacket))
+	for i := range r.headers {
+		ph := int32(r.headers[len(r.headers)-1-i])
+		sp[8+i] = ph
+		sp[12+i] = ph
+	}
+	b := make([]byte, statusPacketSize)
+	sp.Encode(b)
+	return b
+}
+
+// Reply to the control packet with the given ID, nil if no longer kept
+func (r *replayBuffer) resend(id IPbusPacketID) []byte {
+	for i, ph := range r.headers {
+		if ph.ID() == id {
+			return r.sent[i]
+		}
+	}
+	return nil
+}
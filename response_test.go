@@ -0,0 +1,114 @@
+package goipbus
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeControlPacket(t *testing.T) {
+	// Packet header:		20 0005 f 0
+	b := []byte{
+		0x20, 0x00, 0x05, 0xf0,
+		// Read, 2 words
+		0x20, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x0a, 0x00, 0x00, 0x00, 0x0b,
+		// Non-incrementing read, 1 word
+		0x20, 0x02, 0x01, 0x20, 0xca, 0xfe, 0xca, 0xfe,
+		// Write, 3 words
+		0x20, 0x03, 0x03, 0x10,
+		// Non-incrementing write, 2 words
+		0x20, 0x04, 0x02, 0x30,
+		// RMWbits
+		0x20, 0x05, 0x01, 0x40, 0x00, 0x00, 0x00, 0xff,
+		// RMWsum
+		0x20, 0x06, 0x01, 0x50, 0x00, 0x00, 0x00, 0x01,
+		// Configuration space read, 1 word
+		0x20, 0x07, 0x01, 0x60, 0x12, 0x34, 0x56, 0x78,
+		// Configuration space write, 1 word
+		0x20, 0x08, 0x01, 0x70,
+		// Read, bus error without payload
+		0x20, 0x09, 0x04, 0x04,
+	}
+	ph, resps, err := DecodeControlPacket(b)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if ph.ID() != 5 || ph.Type() != ControlPacket || ph.ByteOrder() != BigEndian {
+		t.Errorf("Expected packet ID 5, generated header %#x\n", ph)
+	}
+	expected := []struct {
+		typeId   IPbusTransactionTypeID
+		infoCode IPbusInfoCode
+		data     []IPbusWord
+	}{
+		{ReadTypeID, RequestHandledSuccesfully, []IPbusWord{0xa, 0xb}},
+		{NonIncrementalReadTypeID, RequestHandledSuccesfully, []IPbusWord{-0x35013502}},
+		{WriteTypeID, RequestHandledSuccesfully, nil},
+		{NonIncrementalWriteTypeID, RequestHandledSuccesfully, nil},
+		{RMWbitsTypeID, RequestHandledSuccesfully, []IPbusWord{0xff}},
+		{RMWsumTypeID, RequestHandledSuccesfully, []IPbusWord{0x1}},
+		{ConfigurationSpaceRead, RequestHandledSuccesfully, []IPbusWord{0x12345678}},
+		{ConfigurationSpaceWrite, RequestHandledSuccesfully, nil},
+		{ReadTypeID, BusErrorOnRead, nil},
+	}
+	if len(resps) != len(expected) {
+		t.Fatalf("Expected %v responses, generated %v\n", len(expected), len(resps))
+	}
+	for i, e := range expected {
+		r := resps[i]
+		if r.ID() != IPbusTransactionID(i+1) || r.TypeID() != e.typeId || r.InfoCode() != e.infoCode {
+			t.Errorf("Expected transaction %v type %#x info %#x, generated %v %#x %#x\n",
+				i+1, e.typeId, e.infoCode, r.ID(), r.TypeID(), r.InfoCode())
+		}
+		if len(r.Data()) != len(e.data) {
+			t.Errorf("Expected data %#x, generated %#x\n", e.data, r.Data())
+			continue
+		}
+		for j := range e.data {
+			if r.Data()[j] != e.data[j] {
+				t.Errorf("Expected data %#x, generated %#x\n", e.data, r.Data())
+			}
+		}
+	}
+	if _, ok := resps[8].Err().(*InfoCodeError); !ok {
+		t.Errorf("Expected *InfoCodeError, generated %v\n", resps[8].Err())
+	}
+}
+
+func TestDecodeControlPacketErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		b      []byte
+		err    error
+		offset int
+	}{
+		{"empty", []byte{}, ErrUnexpectedEOF, 0},
+		{"protocol", []byte{0x10, 0x00, 0x00, 0xf0}, ErrProtocolVersion, 0},
+		{"byte-order", []byte{0x20, 0x00, 0x00, 0x50}, ErrByteOrder, 0},
+		{"status packet", []byte{0x20, 0x00, 0x00, 0xf1}, ErrPacketType, 0},
+		{"truncated header", []byte{0x20, 0x00, 0x00, 0xf0, 0x20, 0x00}, ErrUnexpectedEOF, 4},
+		{"truncated read", []byte{0x20, 0x00, 0x00, 0xf0, 0x20, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01}, ErrUnexpectedEOF, 12},
+		{"transaction protocol", []byte{0x20, 0x00, 0x00, 0xf0, 0x30, 0x00, 0x01, 0x10}, ErrProtocolVersion, 4},
+		{"request", []byte{0x20, 0x00, 0x00, 0xf0, 0x20, 0x00, 0x01, 0x1f}, ErrNotResponse, 4},
+		{"RMWbits words", []byte{0x20, 0x00, 0x00, 0xf0, 0x20, 0x00, 0x02, 0x40, 0x00, 0x00, 0x00, 0x01}, ErrWordCount, 4},
+		{"reserved type", []byte{0x20, 0x00, 0x00, 0xf0, 0x20, 0x00, 0x01, 0x80}, errTypeNotSupported, 4},
+	}
+	for _, c := range cases {
+		_, _, err := DecodeControlPacket(c.b)
+		var de *DecodeError
+		if !errors.As(err, &de) || !errors.Is(err, c.err) || de.Offset != c.offset {
+			t.Errorf("%v: expected %v at byte %v, generated %v\n", c.name, c.err, c.offset, err)
+		}
+	}
+}
+
+func TestResponseDecode(t *testing.T) {
+	b := []byte{0x20, 0x0a, 0x01, 0x50, 0x00, 0x00, 0x00, 0x07, 0xff}
+	var resp IPbusResponse
+	n, err := resp.Decode(b)
+	if err != nil || n != 8 {
+		t.Fatalf("Expected 8 bytes, generated %v (%v)\n", n, err)
+	}
+	if resp.ID() != 0xa || resp.TypeID() != RMWsumTypeID || resp.Data()[0] != 0x7 {
+		t.Errorf("Expected RMWsum 0x7, generated %#x\n", resp.Data())
+	}
+}
@@ -0,0 +1,143 @@
+// GoIPbus word ring buffer
+// as circular_buffer.c of softipbus
+
+package goipbus
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrRingFull is returned when the words do not fit in the free space of a ring
+var ErrRingFull = errors.New("IPbus ring buffer full")
+
+// WordRing is a ring buffer of 32-bit words decoupling the I/O of a target
+// from its transaction handling. It is safe without locks for one producer
+// goroutine, calling Append, PushBack and Free, and one consumer goroutine,
+// calling the other methods; Len may be called by both. The Server reads each
+// TCP client into one.
+type WordRing struct {
+	data []uint32
+	mask uint32
+	// Free running word counts, the positions are taken modulo len(data)
+	head uint32 // words consumed, written by the consumer only
+	tail uint32 // words produced, written by the producer only
+}
+
+// NewWordRing returns an empty ring holding at least size words, the
+// capacity is rounded up to a power of two
+func NewWordRing(size int) *WordRing {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+	return &WordRing{data: make([]uint32, n), mask: uint32(n - 1)}
+}
+
+// Cap returns the number of words the ring holds when full
+func (r *WordRing) Cap() int {
+	return len(r.data)
+}
+
+// Len returns the number of words in the ring
+func (r *WordRing) Len() int {
+	return int(atomic.LoadUint32(&r.tail) - atomic.LoadUint32(&r.head))
+}
+
+// Free returns the number of words that can be appended
+func (r *WordRing) Free() int {
+	return len(r.data) - int(r.tail-atomic.LoadUint32(&r.head))
+}
+
+// Append adds the words at the end of the ring. Nothing is added if they do
+// not all fit.
+func (r *WordRing) Append(words []uint32) error {
+	if len(words) > r.Free() {
+		return ErrRingFull
+	}
+	i := r.tail & r.mask
+	n := copy(r.data[i:], words)
+	copy(r.data, words[n:])
+	// publish the words to the consumer
+	atomic.StoreUint32(&r.tail, r.tail+uint32(len(words)))
+	return nil
+}
+
+// PushBack adds one word at the end of the ring
+func (r *WordRing) PushBack(word uint32) error {
+	if r.Free() == 0 {
+		return ErrRingFull
+	}
+	r.data[r.tail&r.mask] = word
+	atomic.StoreUint32(&r.tail, r.tail+1)
+	return nil
+}
+
+// At returns the word at index i from the front of the ring, i must be less
+// than Len
+func (r *WordRing) At(i int) uint32 {
+	if i < 0 || i >= r.Len() {
+		panic("goipbus: ring index out of range")
+	}
+	return r.data[(r.head+uint32(i))&r.mask]
+}
+
+// Contiguous returns the number of words at the front of the ring stored
+// before it wraps around
+func (r *WordRing) Contiguous() int {
+	n := r.Len()
+	if end := len(r.data) - int(r.head&r.mask); n > end {
+		return end
+	}
+	return n
+}
+
+// Peek returns the next n words, or all of them if fewer, without copying or
+// consuming them: first holds the words before the end of the storage and
+// second the words after it wraps around. The slices are valid until the
+// words are consumed.
+func (r *WordRing) Peek(n int) (first, second []uint32) {
+	if l := r.Len(); n > l {
+		n = l
+	}
+	i := int(r.head & r.mask)
+	if i+n <= len(r.data) {
+		return r.data[i : i+n], nil
+	}
+	return r.data[i:], r.data[:i+n-len(r.data)]
+}
+
+// Read copies the next words into dst without consuming them, returns the
+// number of words copied
+func (r *WordRing) Read(dst []uint32) int {
+	first, second := r.Peek(len(dst))
+	n := copy(dst, first)
+	return n + copy(dst[n:], second)
+}
+
+// Discard consumes up to n words from the front of the ring, returns the
+// number of words consumed
+func (r *WordRing) Discard(n int) int {
+	if l := r.Len(); n > l {
+		n = l
+	}
+	// hand the space back to the producer
+	atomic.StoreUint32(&r.head, r.head+uint32(n))
+	return n
+}
+
+// Pop copies and consumes the next words into dst, returns the number of
+// words consumed
+func (r *WordRing) Pop(dst []uint32) int {
+	return r.Discard(r.Read(dst))
+}
+
+// PopFront consumes the front word, ok is false if the ring is empty
+func (r *WordRing) PopFront() (word uint32, ok bool) {
+	if r.Len() == 0 {
+		return 0, false
+	}
+	word = r.data[r.head&r.mask]
+	r.Discard(1)
+	return word, true
+}
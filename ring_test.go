@@ -0,0 +1,133 @@
+package goipbus
+
+import (
+	"runtime"
+	"testing"
+)
+
+// Ring whose front is n words before the end of its storage
+func ringAt(t *testing.T, size, n int) *WordRing {
+	r := NewWordRing(size)
+	r.Append(make([]uint32, r.Cap()-n))
+	if r.Discard(r.Cap()-n) != r.Cap()-n {
+		t.Fatalf("Error positioning the ring\n")
+	}
+	return r
+}
+
+func TestWordRingNew(t *testing.T) {
+	r := NewWordRing(200)
+	if r.Cap() != 256 || r.Len() != 0 || r.Free() != 256 || r.Contiguous() != 0 {
+		t.Errorf("Expected empty ring of 256 words, generated cap %v len %v free %v\n", r.Cap(), r.Len(), r.Free())
+	}
+	if _, ok := r.PopFront(); ok {
+		t.Errorf("Expected no word from an empty ring\n")
+	}
+}
+
+func TestWordRingAppend(t *testing.T) {
+	r := NewWordRing(8)
+	if err := r.Append([]uint32{0, 1, 2, 3, 4}); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	// Too many words, nothing is added
+	if err := r.Append([]uint32{5, 6, 7, 8}); err != ErrRingFull || r.Len() != 5 {
+		t.Errorf("Expected %v and 5 words, generated %v and %v words\n", ErrRingFull, err, r.Len())
+	}
+	for i := 5; i < 8; i++ {
+		if err := r.PushBack(uint32(i)); err != nil {
+			t.Fatalf("Error %v\n", err)
+		}
+		if r.Free() != 7-i {
+			t.Errorf("Expected %v free words, generated %v\n", 7-i, r.Free())
+		}
+	}
+	if err := r.PushBack(8); err != ErrRingFull {
+		t.Errorf("Expected %v, generated %v\n", ErrRingFull, err)
+	}
+	for i := 0; i < 8; i++ {
+		if r.At(i) != uint32(i) {
+			t.Errorf("Expected %v at %v, generated %v\n", i, i, r.At(i))
+		}
+	}
+}
+
+func TestWordRingWraps(t *testing.T) {
+	data := []uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	r := ringAt(t, 16, 5)
+	if err := r.Append(data); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if r.Len() != 11 || r.Contiguous() != 5 {
+		t.Errorf("Expected 11 words, 5 contiguous, generated %v and %v\n", r.Len(), r.Contiguous())
+	}
+	first, second := r.Peek(8)
+	if len(first) != 5 || len(second) != 3 || first[4] != 4 || second[0] != 5 || second[2] != 7 {
+		t.Errorf("Expected 0-4 and 5-7, generated %v and %v\n", first, second)
+	}
+	for i := range data {
+		if r.At(i) != data[i] {
+			t.Errorf("Expected %v at %v, generated %v\n", data[i], i, r.At(i))
+		}
+	}
+
+	dst := make([]uint32, 20)
+	if n := r.Read(dst); n != 11 || r.Len() != 11 {
+		t.Errorf("Expected 11 words read and kept, generated %v and %v\n", n, r.Len())
+	}
+	for i := range data {
+		if dst[i] != data[i] {
+			t.Errorf("Expected %v, generated %v\n", data, dst[:11])
+			break
+		}
+	}
+
+	if n := r.Discard(5); n != 5 || r.Len() != 6 || r.At(0) != 5 || r.Contiguous() != 6 {
+		t.Errorf("Expected 5 words deleted and 6 left from 5, generated %v and %v\n", n, r.Len())
+	}
+	if n := r.Pop(dst[:4]); n != 4 || dst[0] != 5 || dst[3] != 8 || r.Len() != 2 {
+		t.Errorf("Expected 5-8 popped, generated %v\n", dst[:n])
+	}
+	if n := r.Discard(10); n != 2 || r.Len() != 0 {
+		t.Errorf("Expected 2 words deleted up to the end, generated %v\n", n)
+	}
+}
+
+func TestWordRingConcurrent(t *testing.T) {
+	const words = 10000
+	r := NewWordRing(64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		chunk := make([]uint32, 7)
+		for i := 0; i < words; {
+			n := len(chunk)
+			if words-i < n {
+				n = words - i
+			}
+			for j := 0; j < n; j++ {
+				chunk[j] = uint32(i + j)
+			}
+			if r.Append(chunk[:n]) != nil {
+				runtime.Gosched()
+				continue
+			}
+			i += n
+		}
+	}()
+
+	dst := make([]uint32, 5)
+	for i := 0; i < words; {
+		n := r.Pop(dst)
+		if n == 0 {
+			runtime.Gosched()
+		}
+		for j := 0; j < n; j++ {
+			if dst[j] != uint32(i+j) {
+				t.Fatalf("Expected %v, generated %v\n", i+j, dst[j])
+			}
+		}
+		i += n
+	}
+	<-done
+}
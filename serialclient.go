@@ -0,0 +1,121 @@
+// GoIPbus serial-line transport
+
+package goipbus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// Default UART settings of the CTP6 front-end link
+const DefaultBaud = 115200
+const DefaultSerialDevice = "/dev/ttyUL1"
+
+// SerialClient sends IPbus transactions over a UART, using the framing of the
+// softipbus forwarding handler: the transactions of a control packet are
+// written as a raw stream of big-endian words, without the packet header, and
+// the front-end answers each transaction in order. Dispatch calls from several
+// goroutines are serialised.
+type SerialClient struct {
+	mu      sync.Mutex
+	port    io.ReadWriteCloser
+	r       *bufio.Reader
+	session *Session
+}
+
+// OpenSerial opens the serial device name at the given baud rate. timeout
+// bounds every read from the line, DefaultTimeout if zero.
+func OpenSerial(name string, baud int, timeout time.Duration) (*SerialClient, error) {
+	if baud == 0 {
+		baud = DefaultBaud
+	}
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	port, err := serial.OpenPort(&serial.Config{Name: name, Baud: baud, ReadTimeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	return newSerialClient(port), nil
+}
+
+// Wrap an already opened line
+func newSerialClient(port io.ReadWriteCloser) *SerialClient {
+	return &SerialClient{port: port, r: bufio.NewReader(port), session: NewSession()}
+}
+
+// Dispatch writes the transactions of the control packet and reads back one
+// response per transaction
+func (c *SerialClient) Dispatch(cp *IPbusControlPacket) (resps []IPbusResponse, err error) {
+	return c.DispatchContext(context.Background(), cp)
+}
+
+// DispatchContext is Dispatch aborted when ctx is done. Lines without read
+// deadlines, as the UART devices, cannot be interrupted: the wait is then only
+// bounded by the read timeout of the line.
+func (c *SerialClient) DispatchContext(ctx context.Context, cp *IPbusControlPacket) (resps []IPbusResponse, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err = contextDone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Without the packet header the front-end cannot tell the byte order
+	if c.session.ByteOrder() != BigEndian {
+		return nil, ErrByteOrder
+	}
+	b := make([]byte, cp.RequestSize())
+	n, err := c.session.Encode(cp, b)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := c.port.(interface{ SetReadDeadline(time.Time) error }); ok {
+		// clear the deadline left by an earlier cancellation
+		d.SetReadDeadline(time.Time{})
+		stop := watchContext(ctx, d.SetReadDeadline)
+		defer stop()
+	}
+	// Skip the packet header, the front-end only handles transactions
+	_, err = c.port.Write(b[4:n])
+	if err != nil {
+		return nil, err
+	}
+
+	trans, err := readTransactions(c.r, cp.Len(), binary.BigEndian)
+	if err != nil {
+		if cerr := contextDone(ctx); cerr != nil {
+			return nil, cerr
+		}
+	}
+	if err != nil {
+		// The line read timeout is reported as end of file
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrTimeout
+		}
+		return nil, err
+	}
+	reply := make([]byte, 4, 4+len(trans))
+	binary.BigEndian.PutUint32(reply, uint32(cp.ph))
+	_, resps, err = DecodeControlPacket(append(reply, trans...))
+	if err != nil {
+		return resps, err
+	}
+	return resps, cp.checkReply(resps)
+}
+
+// Session returns the ID sequences used with the front-end
+func (c *SerialClient) Session() *Session {
+	return c.session
+}
+
+// Close closes the serial line
+func (c *SerialClient) Close() error {
+	return c.port.Close()
+}
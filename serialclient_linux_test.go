@@ -0,0 +1,103 @@
+package goipbus
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// Open a pseudo-terminal pair, returns the master side and the slave device name
+func openPty(t *testing.T) (master *os.File, slave string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("pseudo-terminals not available: %v", err)
+	}
+	var n uint32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	if errno != 0 {
+		t.Fatalf("Error %v\n", errno)
+	}
+	var unlock int32
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	if errno != 0 {
+		t.Fatalf("Error %v\n", errno)
+	}
+	return master, "/dev/pts/" + strconv.Itoa(int(n))
+}
+
+// Front-end stand-in answering raw transactions on the master side of a pty
+func serialStandIn(master io.ReadWriter, mem map[BaseAddress]IPbusWord) {
+	readWord := func() (uint32, error) {
+		b := make([]byte, 4)
+		_, err := io.ReadFull(master, b)
+		return binary.BigEndian.Uint32(b), err
+	}
+	for {
+		word, err := readWord()
+		if err != nil {
+			return
+		}
+		req := []uint32{word}
+		for len(req) < standInRequestSize(word) {
+			w, err := readWord()
+			if err != nil {
+				return
+			}
+			req = append(req, w)
+		}
+		reply, _ := standInTransaction(req, mem)
+		binary.Write(master, binary.BigEndian, reply)
+	}
+}
+
+func TestSerialClientDispatch(t *testing.T) {
+	master, slave := openPty(t)
+	defer master.Close()
+	mem := map[BaseAddress]IPbusWord{0x6000: 0x12345678}
+	go serialStandIn(master, mem)
+
+	c, err := OpenSerial(slave, DefaultBaud, 0)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+
+	cp := new(IPbusControlPacket)
+	cp.Append(NewReadRequest(0x6000, 1))
+	cp.Append(NewNonIncrementalWriteRequest(0x60F0, []IPbusWord{0x1, 0xfff}))
+	cp.Append(NewReadRequest(0x60F0, 1))
+	resps, err := c.Dispatch(cp)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if d := resps[0].Data(); len(d) != 1 || d[0] != 0x12345678 {
+		t.Errorf("Expected word 0x12345678, generated %#x\n", d)
+	}
+	if d := resps[2].Data(); len(d) != 1 || d[0] != 0xfff {
+		t.Errorf("Expected word 0xfff, generated %#x\n", d)
+	}
+}
+
+func TestSerialClientTimeout(t *testing.T) {
+	master, slave := openPty(t)
+	defer master.Close()
+	go io.Copy(io.Discard, master)
+
+	c, err := OpenSerial(slave, DefaultBaud, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+
+	cp := new(IPbusControlPacket)
+	cp.Append(NewReadRequest(0x0, 1))
+	_, err = c.Dispatch(cp)
+	if err != ErrTimeout {
+		t.Errorf("Expected %v, generated %v\n", ErrTimeout, err)
+	}
+}
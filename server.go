@@ -0,0 +1,350 @@
+// GoIPbus target server, ported from softipbus serve-tcp
+
+package goipbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Default ports of the softipbus TCP and UDP targets
+const (
+	DefaultTCPPort = 60002
+	DefaultUDPPort = 50001
+)
+
+// Largest chunk read from a client at once, the IPbus MTU
+const maxRequestSize = maxByteSize
+
+// Error returned by the Serve methods once the server is closed
+var ErrServerClosed = errors.New("IPbus server closed")
+
+// Server is an IPbus 2.0 target serving a MemoryBackend to TCP and UDP
+// clients, the Go counterpart of softipbus serve-tcp.
+//
+// TCP clients use the bare packet framing of softipbus: packet headers are
+// echoed as soon as they arrive and each transaction is answered once it is
+// complete. Each UDP datagram carries a whole control packet; UDP targets
+// answer status and re-send requests, so that clients can enable
+// reliability. Transactions from all clients are executed one at a time.
+type Server struct {
+	// Memory is the bus served to the clients
+	Memory MemoryBackend
+	// Config is the configuration space, transactions on it fail with a bus
+	// error if nil
+	Config MemoryBackend
+
+	// Executes the transactions instead of Memory if set
+	handler transactionHandler
+	// Serialises the bus access of all the clients
+	busMu sync.Mutex
+
+	mu      sync.Mutex
+	closers map[io.Closer]struct{}
+	closed  bool
+}
+
+// NewServer returns a server for the memory backend mem
+func NewServer(mem MemoryBackend) *Server {
+	return &Server{Memory: mem}
+}
+
+// ListenAndServe listens on the tcp or udp network address addr and serves
+// the clients until the server is closed
+func (s *Server) ListenAndServe(network, addr string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			return err
+		}
+		return s.ServeTCP(l)
+	case "udp", "udp4", "udp6":
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return err
+		}
+		return s.ServeUDP(conn)
+	}
+	return net.UnknownNetworkError(network)
+}
+
+// ServeTCP accepts clients on l, each one is served in its own goroutine
+func (s *Server) ServeTCP(l net.Listener) error {
+	if !s.track(l) {
+		return ErrServerClosed
+	}
+	defer s.untrack(l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Serve a TCP client until it disconnects. A reader goroutine stores the
+// words received into a ring, this goroutine handles them: a client streaming
+// requests is read while the previous transactions are executed.
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	r := NewWordRing(int(maxRequestSize) / 4)
+	ready := make(chan struct{}, 1) // words appended to the ring
+	space := make(chan struct{}, 1) // words consumed from the ring
+	done := make(chan struct{})     // handler gone, the reader stops
+	eof := make(chan struct{})      // reader gone, nothing more is appended
+	defer close(done)
+	go readConn(conn, r, ready, space, done, eof)
+
+	c := new(streamClient)
+	words := make([]uint32, r.Cap())
+	for {
+		n := r.Pop(words)
+		if n == 0 {
+			select {
+			case <-ready:
+			case <-eof:
+				if r.Len() == 0 {
+					return
+				}
+			}
+			continue
+		}
+		notify(space)
+		for _, w := range words[:n] {
+			c.input = appendWord(c.input, w)
+		}
+		processInputStream(c, s)
+		if len(c.output) > 0 {
+			_, err := conn.Write(c.output)
+			if err != nil {
+				return
+			}
+			c.output = c.output[:0]
+		}
+	}
+}
+
+// Append the whole words read from conn to r, waiting for space when it is
+// full, until conn fails or done is closed. A trailing partial word is kept
+// until the rest of it arrives.
+func readConn(conn net.Conn, r *WordRing, ready, space, done, eof chan struct{}) {
+	defer close(eof)
+	b := make([]byte, maxRequestSize)
+	var partial int
+	words := make([]uint32, len(b)/4)
+	for {
+		n, err := conn.Read(b[partial:])
+		n += partial
+		w := words[:n/4]
+		for i := range w {
+			w[i] = binary.BigEndian.Uint32(b[4*i:])
+		}
+		partial = copy(b, b[4*len(w):n])
+		for len(w) > 0 {
+			free := r.Free()
+			if free == 0 {
+				select {
+				case <-space:
+					continue
+				case <-done:
+					return
+				}
+			}
+			if free > len(w) {
+				free = len(w)
+			}
+			r.Append(w[:free])
+			w = w[free:]
+			notify(ready)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Wake up the goroutine waiting on ch, if not already woken up
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// ServeUDP answers the control packets received on conn, along with the
+// status and re-send requests of the reliability mechanism. Control packets
+// with a non-zero ID are served in sequence and their last replies kept to
+// be re-sent; all the clients of conn share the sequence.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	if !s.track(conn) {
+		return ErrServerClosed
+	}
+	defer s.untrack(conn)
+	r := new(replayBuffer)
+	b := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if n < 4 {
+			continue
+		}
+		ph := readPacketHeader(b[:n])
+		if !validPacketHeader(uint32(ph)) {
+			continue
+		}
+		switch ph.Type() {
+		case StatusPacket:
+			if ph.ByteOrder() == BigEndian {
+				conn.WriteTo(r.status(ph), addr)
+			}
+			continue
+		case RequestPacket:
+			if reply := r.resend(ph.ID()); reply != nil {
+				conn.WriteTo(reply, addr)
+			}
+			continue
+		}
+		c := &streamClient{input: b[:n]}
+		switch streamState(c) {
+		case IPBUS_ISTREAM_PACKET, IPBUS_ISTREAM_PACKET_SWP_ORD:
+		default:
+			continue
+		}
+		// Out of sequence packets are dropped, as by the IPbus targets
+		if !r.accept(ph) {
+			continue
+		}
+		processInputStream(c, s)
+		r.record(ph, c.output)
+		conn.WriteTo(c.output, addr)
+	}
+}
+
+// Close stops all the listeners and disconnects all the clients
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	for c := range s.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	s.closers = nil
+	return err
+}
+
+// Register a listener or connection to be closed with the server, reports
+// false if the server is already closed
+func (s *Server) track(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.closers == nil {
+		s.closers = make(map[io.Closer]struct{})
+	}
+	s.closers[c] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.closers, c)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Execute a request transaction, one at a time for all the clients
+func (s *Server) handleTransaction(req *IPbusRequest) IPbusResponse {
+	s.busMu.Lock()
+	defer s.busMu.Unlock()
+	if s.handler != nil {
+		return s.handler.handleTransaction(req)
+	}
+	return memoryTransaction(s.Memory, s.Config, req)
+}
+
+// Execute a request transaction on the memory backend mem, or on the
+// configuration space config, as the softipbus handlers
+func memoryTransaction(mem, config MemoryBackend, req *IPbusRequest) IPbusResponse {
+	resp := IPbusResponse{id: req.id, words: req.words, typeId: req.typeId, infoCode: RequestHandledSuccesfully}
+	switch req.typeId {
+	case ConfigurationSpaceRead, ConfigurationSpaceWrite:
+		mem = config
+	}
+	if mem == nil {
+		resp.infoCode = BusErrorOnRead
+		if req.typeId == ConfigurationSpaceWrite {
+			resp.infoCode = BusErrorOnWrite
+		}
+		return resp
+	}
+
+	var err error
+	switch req.typeId {
+	case ReadTypeID, ConfigurationSpaceRead:
+		resp.data = make([]IPbusWord, req.words)
+		err = mem.ReadBlock(req.addr, resp.data)
+	case NonIncrementalReadTypeID:
+		// read the same place a bunch of times
+		resp.data = make([]IPbusWord, req.words)
+		for i := 0; i < len(resp.data) && err == nil; i++ {
+			resp.data[i], err = mem.ReadWord(req.addr)
+		}
+	case WriteTypeID, ConfigurationSpaceWrite:
+		err = mem.WriteBlock(req.addr, req.data)
+	case NonIncrementalWriteTypeID:
+		for i := 0; i < len(req.data) && err == nil; i++ {
+			err = mem.WriteWord(req.addr, req.data[i])
+		}
+	case RMWbitsTypeID:
+		// Read/modify/write returns the original contents
+		resp.data = make([]IPbusWord, 1)
+		resp.data[0], err = mem.RMWBits(req.addr, req.data[0], req.data[1])
+	case RMWsumTypeID:
+		resp.data = make([]IPbusWord, 1)
+		resp.data[0], err = mem.RMWSum(req.addr, req.data[0])
+	}
+	if err != nil {
+		switch req.typeId {
+		case WriteTypeID, NonIncrementalWriteTypeID, ConfigurationSpaceWrite:
+			return busError(resp, BusErrorOnWrite)
+		}
+		return busError(resp, BusErrorOnRead)
+	}
+	return resp
+}
+
+// Turn resp into an error response without payload
+func busError(resp IPbusResponse, code IPbusInfoCode) IPbusResponse {
+	resp.infoCode = code
+	resp.data = nil
+	return resp
+}
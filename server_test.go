@@ -0,0 +1,290 @@
+package goipbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Start srv on both transports of the loopback interface
+func testServer(t *testing.T, srv *Server) (tcpAddr, udpAddr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	go srv.ServeTCP(l)
+	go srv.ServeUDP(conn)
+	return l.Addr().String(), conn.LocalAddr().String()
+}
+
+// Read a server memory word from the test goroutine
+func peekServer(srv *Server, addr BaseAddress) IPbusWord {
+	srv.busMu.Lock()
+	defer srv.busMu.Unlock()
+	v, _ := srv.Memory.ReadWord(addr)
+	return v
+}
+
+// Big-endian bytes of the words
+func wordBytes(word ...uint32) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, word)
+	return buf.Bytes()
+}
+
+func TestProcessInputStream(t *testing.T) {
+	mem := NewRAM(0x10)
+	mem[0x2] = 0x12345678
+	c := new(streamClient)
+	// packet header, read of 2 words at 0x2, write of 1 word at 0x4
+	in := wordBytes(0x200000f0, 0x2000020f, 0x2, 0x2001011f, 0x4, 0xcafe)
+
+	// Fed in arbitrary chunks, partial words and transactions wait for more data
+	states := []int{IPBUS_ISTREAM_EMPTY, IPBUS_ISTREAM_PARTIAL_TRANS, IPBUS_ISTREAM_PARTIAL_TRANS}
+	for i, cut := range []int{3, 7, 11} {
+		c.input = append(c.input, in[:cut]...)
+		in = in[cut:]
+		processInputStream(c, NewServer(mem))
+		if s := streamState(c); s != states[i] {
+			t.Errorf("Expected stream state %v, generated %v\n", states[i], s)
+		}
+	}
+	c.input = append(c.input, in...)
+	processInputStream(c, NewServer(mem))
+
+	expected := wordBytes(0x200000f0, 0x20000200, 0x12345678, 0x0, 0x20010110)
+	if !bytes.Equal(c.output, expected) {
+		t.Errorf("Expected %#x, generated %#x\n", expected, c.output)
+	}
+	if mem[0x4] != 0xcafe || len(c.input) != 0 {
+		t.Errorf("Expected memory 0xcafe, generated %#x (%v bytes left)\n", mem[0x4], len(c.input))
+	}
+}
+
+func TestProcessInputStreamSwapped(t *testing.T) {
+	mem := NewRAM(0x10)
+	mem[0x1] = 0x11223344
+	c := new(streamClient)
+	// little-endian packet header followed by an RMWsum at 0x1
+	for _, w := range []uint32{0x200000f0, 0x2000015f, 0x1, 0x1} {
+		c.input = binary.LittleEndian.AppendUint32(c.input, w)
+	}
+	if s := streamState(c); s != IPBUS_ISTREAM_PACKET_SWP_ORD {
+		t.Fatalf("Expected stream state %v, generated %v\n", IPBUS_ISTREAM_PACKET_SWP_ORD, s)
+	}
+	processInputStream(c, NewServer(mem))
+
+	var expected []byte
+	for _, w := range []uint32{0x200000f0, 0x20000150, 0x11223344} {
+		expected = binary.LittleEndian.AppendUint32(expected, w)
+	}
+	if !bytes.Equal(c.output, expected) || mem[0x1] != 0x11223345 {
+		t.Errorf("Expected %#x, generated %#x\n", expected, c.output)
+	}
+}
+
+func TestServerTransactions(t *testing.T) {
+	srv := NewServer(NewRAM(0x100))
+	srv.Config = RAM{0xc0ffee}
+	tcpAddr, udpAddr := testServer(t, srv)
+	defer srv.Close()
+
+	for _, uri := range []string{TCPScheme + "://" + tcpAddr, UDPScheme + "://" + udpAddr} {
+		c, err := Open(uri)
+		if err != nil {
+			t.Fatalf("Error %v\n", err)
+		}
+		defer c.Close()
+
+		cp := new(IPbusControlPacket)
+		cp.Append(NewWriteRequest(0x10, []IPbusWord{0x1, 0x2, 0x3}))
+		cp.Append(NewReadRequest(0x10, 3))
+		cp.Append(NewNonIncrementalWriteRequest(0x20, []IPbusWord{0x4, 0x5}))
+		cp.Append(NewNonIncrementalReadRequest(0x20, 2))
+		cp.Append(NewRMWbitsRequest(0x10, 0x0, 0xf0))
+		cp.Append(NewRMWsumRequest(0x11, 0x10))
+		cp.Append(NewConfigurationSpaceReadRequest(0x0, 1))
+		resps, err := c.Dispatch(cp)
+		if err != nil {
+			t.Fatalf("Error %v\n", err)
+		}
+		expected := [][]IPbusWord{nil, {0x1, 0x2, 0x3}, nil, {0x5, 0x5}, {0x1}, {0x2}, {0xc0ffee}}
+		for i := range expected {
+			d := resps[i].Data()
+			if len(d) != len(expected[i]) {
+				t.Fatalf("Expected %#x, generated %#x\n", expected[i], d)
+			}
+			for j := range d {
+				if d[j] != expected[i][j] {
+					t.Errorf("Expected %#x, generated %#x\n", expected[i], d)
+				}
+			}
+		}
+		if peekServer(srv, 0x10) != 0xf0 || peekServer(srv, 0x11) != 0x12 {
+			t.Errorf("Expected memory 0xf0 0x12, generated %#x %#x\n", peekServer(srv, 0x10), peekServer(srv, 0x11))
+		}
+
+		cp = new(IPbusControlPacket)
+		cp.Append(NewReadRequest(0xff, 2))
+		_, err = c.Dispatch(cp)
+		if ie, ok := err.(*InfoCodeError); !ok || ie.InfoCode != BusErrorOnRead {
+			t.Errorf("Expected bus error on read, generated %v\n", err)
+		}
+	}
+}
+
+func TestServerReliability(t *testing.T) {
+	srv := NewServer(NewRAM(0x100))
+	srv.Memory.WriteWord(0x10, 0x1234)
+	_, udpAddr := testServer(t, srv)
+	defer srv.Close()
+
+	conn, err := net.Dial("udp", udpAddr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer conn.Close()
+	exchange := func(b []byte) []byte {
+		conn.Write(b)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		reply := make([]byte, maxDatagramSize)
+		n, err := conn.Read(reply)
+		if err != nil {
+			t.Fatalf("Error %v\n", err)
+		}
+		return reply[:n]
+	}
+	status := func() *IPbusStatusPacket {
+		b := make([]byte, statusPacketSize)
+		NewStatusRequest().Encode(b)
+		sp := new(IPbusStatusPacket)
+		err := sp.Decode(exchange(b))
+		if err != nil {
+			t.Fatalf("Error %v\n", err)
+		}
+		return sp
+	}
+
+	sp := status()
+	if sp.NextPacketID() != 1 || sp.Buffers() != replayBuffers || sp.MTU() != uint32(maxRequestSize) {
+		t.Errorf("Expected next ID 0x1, generated %#x (%v buffers, MTU %v)\n", sp.NextPacketID(), sp.Buffers(), sp.MTU())
+	}
+
+	// Packet ID 0x0 leaves the sequence alone
+	reply := exchange(wordBytes(0x200000f0, 0x2000010f, 0x10))
+	if !bytes.Equal(reply, wordBytes(0x200000f0, 0x20000100, 0x1234)) {
+		t.Errorf("Expected read 0x1234, generated %#x\n", reply)
+	}
+	request := wordBytes(0x200001f0, 0x2001010f, 0x10)
+	reply = exchange(request)
+	expected := wordBytes(0x200001f0, 0x20010100, 0x1234)
+	if !bytes.Equal(reply, expected) {
+		t.Errorf("Expected %#x, generated %#x\n", expected, reply)
+	}
+	sp = status()
+	if sp.NextPacketID() != 2 || !sp.sent(0x200001f0) || sp.ReceivedHeaders()[0] != 0x200001f0 {
+		t.Errorf("Expected next ID 0x2 after 0x200001f0, generated %#x %#x\n", sp.NextPacketID(), sp.SentHeaders())
+	}
+
+	// Lost reply
+	rb := make([]byte, 4)
+	NewResendRequest(1).Encode(rb)
+	reply = exchange(rb)
+	if !bytes.Equal(reply, expected) {
+		t.Errorf("Expected %#x, generated %#x\n", expected, reply)
+	}
+
+	// Out of sequence packets are dropped
+	conn.Write(wordBytes(0x200003f0, 0x2002010f, 0x10))
+	if sp = status(); sp.NextPacketID() != 2 {
+		t.Errorf("Expected next ID 0x2, generated %#x\n", sp.NextPacketID())
+	}
+
+	c := dialReliable(t, udpAddr)
+	defer c.Close()
+	cp := new(IPbusControlPacket)
+	cp.Append(NewReadRequest(0x10, 1))
+	resps, err := c.Dispatch(cp)
+	if err != nil || resps[0].Data()[0] != 0x1234 || c.Session().PacketID() != 3 {
+		t.Errorf("Expected read 0x1234 with packet ID 0x2, generated %v %v\n", resps, err)
+	}
+}
+
+func TestServerStream(t *testing.T) {
+	srv := NewServer(NewRAM(0x100))
+	tcpAddr, _ := testServer(t, srv)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer conn.Close()
+
+	// More packets than the ring of the connection holds, sent in chunks
+	// splitting the words
+	const packets = 500
+	var in []uint32
+	for i := 0; i < packets; i++ {
+		in = append(in, 0x200000f0|uint32(i)<<8, 0x2000011f|uint32(i)<<16, 0x10, uint32(i))
+	}
+	b := wordBytes(in...)
+	go func() {
+		for len(b) > 0 {
+			n := 7
+			if len(b) < n {
+				n = len(b)
+			}
+			if _, err := conn.Write(b[:n]); err != nil {
+				return
+			}
+			b = b[n:]
+		}
+	}()
+
+	reply := make([]byte, 8*packets)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	for i := 0; i < packets; i++ {
+		ph := binary.BigEndian.Uint32(reply[8*i:])
+		th := binary.BigEndian.Uint32(reply[8*i+4:])
+		if ph != 0x200000f0|uint32(i)<<8 || th != 0x20000110|uint32(i)<<16 {
+			t.Fatalf("Expected reply %v, generated %#x %#x\n", i, ph, th)
+		}
+	}
+	if peekServer(srv, 0x10) != packets-1 {
+		t.Errorf("Expected memory %#x, generated %#x\n", packets-1, peekServer(srv, 0x10))
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	srv := NewServer(NewRAM(1))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	done := make(chan error)
+	go func() { done <- srv.ServeTCP(l) }()
+	c, err := DialTCP(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+
+	srv.Close()
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("Expected %v, generated %v\n", ErrServerClosed, err)
+	}
+	cp := new(IPbusControlPacket)
+	cp.Append(NewReadRequest(0x0, 1))
+	if _, err := c.Dispatch(cp); err == nil {
+		t.Errorf("Expected disconnected client\n")
+	}
+}
@@ -0,0 +1,124 @@
+// GoIPbus session state
+
+package goipbus
+
+import (
+	"sync"
+)
+
+// Session owns the ID sequences of the conversation with one target, so that
+// several targets driven from the same process never share packet or
+// transaction IDs. All methods are safe for concurrent use.
+type Session struct {
+	mu sync.Mutex
+
+	// Next packet ID. The default, 0x0000, is used for non-reliable traffic where
+	// the reliability mechanism is not required; the ID only advances once
+	// reliability is enabled.
+	packetID IPbusPacketID
+
+	// Next transaction ID.
+	// All requests with non-zero ID received by a target must have consecutive ID values. Otherwise the packet header will be considered invalid and the packet will be silently dropped. A target will always accept control packets with ID value of 0.
+	// The IPbus-level reliability mechanism only works with non-zero packet IDs. For simplicity a packet ID of 0x0 can be used for non-reliable traffic at any time. However it should be noted that the simultaneous use of both forms of IPbus traffic with a single target will disrupt the reliability mechanism.
+	transactionID IPbusTransactionID
+
+	// baseAddress store the address of the transaction
+	baseAddress BaseAddress
+
+	// transactionSize define the size of the transaction
+	transactionSize uint8
+
+	// Packet IDs follow the sequence expected by the target's reliability
+	// mechanism
+	reliable bool
+
+	// Control packets are encoded NativeEndian instead of BigEndian
+	native bool
+}
+
+// Session used by the encoders that are not bound to a transport
+var defaultSession = NewSession()
+
+// NewSession returns a session whose ID sequences start at zero
+func NewSession() *Session {
+	return new(Session)
+}
+
+// Reset restarts both ID sequences at zero
+func (s *Session) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resetPacketID()
+	s.resetTransactionID()
+}
+
+// PacketID returns the ID of the next control packet
+func (s *Session) PacketID() IPbusPacketID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.packetID
+}
+
+// SetPacketID sets the ID of the next control packet
+func (s *Session) SetPacketID(id IPbusPacketID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setPacketID(id)
+}
+
+// TransactionID returns the ID of the next transaction
+func (s *Session) TransactionID() IPbusTransactionID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.transactionID
+}
+
+// Reliable reports whether the session takes part in the reliability mechanism
+func (s *Session) Reliable() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reliable
+}
+
+// Start reliable traffic at the packet ID expected next by the target
+func (s *Session) enableReliability(next IPbusPacketID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reliable = true
+	s.setPacketID(next)
+}
+
+// Encode the control packet into b taking the packet ID and consecutive
+// transaction IDs from the session, returns the number of bytes written
+func (s *Session) Encode(cp *IPbusControlPacket, b []byte) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return cp.encode(s, b)
+}
+
+// ByteOrder returns the byte-order qualifier of the control packets encoded
+// by the session, BigEndian by default
+func (s *Session) ByteOrder() IPbusByteOrder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.byteOrder()
+}
+
+func (s *Session) byteOrder() IPbusByteOrder {
+	if s.native {
+		return NativeEndian
+	}
+	return BigEndian
+}
+
+// SetByteOrder selects BigEndian or NativeEndian control packets. Replies
+// are decoded in whatever order the target uses.
+func (s *Session) SetByteOrder(order IPbusByteOrder) error {
+	if order != BigEndian && order != NativeEndian {
+		return ErrByteOrder
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.native = order == NativeEndian
+	return nil
+}
@@ -0,0 +1,99 @@
+package goipbus
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSessionEncode(t *testing.T) {
+	s0 := NewSession()
+	s1 := NewSession()
+
+	b := make([]byte, 64)
+	for i := 0; i < 3; i++ {
+		cp := new(IPbusControlPacket)
+		cp.Append(NewReadRequest(0x0, 1))
+		cp.Append(NewReadRequest(0x1, 1))
+		if _, err := s0.Encode(cp, b); err != nil {
+			t.Fatalf("Error %v\n", err)
+		}
+		// Without reliability every packet has the ID 0x0
+		if cp.ph.ID() != 0 || cp.reqs[1].id != IPbusTransactionID(2*i+1) {
+			t.Errorf("Expected packet 0 transaction %v, generated %v %v\n", 2*i+1, cp.ph.ID(), cp.reqs[1].id)
+		}
+	}
+	if s1.PacketID() != 0 || s1.TransactionID() != 0 {
+		t.Errorf("Expected untouched session, generated packet %v transaction %v\n", s1.PacketID(), s1.TransactionID())
+	}
+	s1.enableReliability(0xffff)
+	for _, expected := range []IPbusPacketID{0xffff, 0x1} {
+		cp := new(IPbusControlPacket)
+		cp.Append(NewReadRequest(0x0, 1))
+		if _, err := s1.Encode(cp, b); err != nil {
+			t.Fatalf("Error %v\n", err)
+		}
+		if cp.ph.ID() != expected {
+			t.Errorf("Expected reliable packet %#x, generated %#x\n", expected, cp.ph.ID())
+		}
+	}
+	s0.Reset()
+	if s0.PacketID() != 0 || s0.TransactionID() != 0 {
+		t.Errorf("Expected reset session, generated packet %v transaction %v\n", s0.PacketID(), s0.TransactionID())
+	}
+}
+
+// Several boards driven in parallel, each from several goroutines
+func TestSessionConcurrentTargets(t *testing.T) {
+	const boards = 4
+	const workers = 8
+	const packets = 20
+
+	var clients []IPbusClient
+	for i := 0; i < boards; i++ {
+		mem := map[BaseAddress]IPbusWord{0x0: IPbusWord(i)}
+		addr, stop := udpStandIn(t, mem)
+		defer stop()
+		c, err := DialUDP(addr)
+		if err != nil {
+			t.Fatalf("Error %v\n", err)
+		}
+		defer c.Close()
+		clients = append(clients, c)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, boards*workers*packets)
+	for i, c := range clients {
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(board int, c IPbusClient) {
+				defer wg.Done()
+				for k := 0; k < packets; k++ {
+					cp := new(IPbusControlPacket)
+					cp.Append(NewReadRequest(0x0, 1))
+					resps, err := c.Dispatch(cp)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if resps[0].Data()[0] != IPbusWord(board) {
+						t.Errorf("Expected board %v, generated %v\n", board, resps[0].Data()[0])
+					}
+				}
+			}(i, c)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Error %v\n", err)
+	}
+	for i, c := range clients {
+		if id := c.Session().PacketID(); id != 0 {
+			t.Errorf("Board %v: expected non-reliable packet ID 0, generated %v\n", i, id)
+		}
+		if id := c.Session().TransactionID(); id != workers*packets {
+			t.Errorf("Board %v: expected next transaction ID %v, generated %v\n", i, workers*packets, id)
+		}
+	}
+}
@@ -6,6 +6,11 @@
 
 package goipbus
 
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
 const (
 	IPBUS_CONTROL_PKT = 0x0 // IPbus control packets are how data is sent/recieved
 	IPBUS_STATUS_PKT  = 0x1 // These two packet types are for data reliability over UDP
@@ -34,10 +39,204 @@ const (
 	IPBUS_ISTREAM_ERR            = 0xF // something went wrong dude
 )
 
-// Process a TCP/IP packet with content stored in buffer coming from the given
-// client. The buffer in the client will be consumed.  Returns number of bytes
-// processed.  The response will be written to the client's output buffer.
-func processInputStream(b []byte) (n IPbusTransactionHeader, err error) {
+// Buffers of a client connection, as the Client structure of softipbus.
+// input holds the bytes received and not processed yet, only whole words are
+// considered as with the ByteBuffer shim; output collects the reply.
+type streamClient struct {
+	input  []byte
+	output []byte
+	// Whether or not this client has the opposite endianness of the stream
+	swapbytes bool
+	// Garbage was found, words are dropped until the next packet header
+	resync bool
+}
+
+// Number of whole words in the input stream
+func (c *streamClient) words() int {
+	return len(c.input) / 4
+}
+
+// Word i of the input stream in the client byte order
+func (c *streamClient) word(i int) uint32 {
+	word := binary.BigEndian.Uint32(c.input[4*i:])
+	if c.swapbytes {
+		word = bits.ReverseBytes32(word)
+	}
+	return word
+}
+
+// Append a word to the output stream in the client byte order
+func (c *streamClient) push(word uint32) {
+	if c.swapbytes {
+		word = bits.ReverseBytes32(word)
+	}
+	c.output = appendWord(c.output, word)
+}
+
+// Append a big-endian word to b
+func appendWord(b []byte, word uint32) []byte {
+	var w [4]byte
+	binary.BigEndian.PutUint32(w[:], word)
+	return append(b, w[:]...)
+}
+
+// Check whether word is a control packet header, returns
+// IPBUS_ISTREAM_PACKET, IPBUS_ISTREAM_PACKET_SWP_ORD or 0. Native-endian
+// headers, byte-order qualifier 0x0, are recognised in both orders; request
+// transaction headers end with the 0xf info code and cannot match them.
+func detectPacketHeader(word uint32) int {
+	msnibble := word & 0xf0000000
+	lsnibble := word & 0xf0
+	if lsnibble == 0x20 && msnibble == 0xf0000000 {
+		// we need to swap the endianness
+		return IPBUS_ISTREAM_PACKET_SWP_ORD
+	} else if nativePacketHeader(word) {
+		return IPBUS_ISTREAM_PACKET
+	} else if nativePacketHeader(bits.ReverseBytes32(word)) {
+		return IPBUS_ISTREAM_PACKET_SWP_ORD
+	} else if lsnibble != 0xf0 || msnibble != 0x20000000 {
+		return 0
+	}
+	return IPBUS_ISTREAM_PACKET
+}
+
+// Whether word is a packet header with the native-endian qualifier
+func nativePacketHeader(word uint32) bool {
+	return word&0xff0000f0 == 0x20000000 && IPbusPacketType(word&0xf) <= RequestPacket
+}
+
+// Number of payload words following a request transaction header. Headers
+// that are not requests carry no payload.
+func requestPayloadSize(words uint8, typeId IPbusTransactionTypeID, infoCode IPbusInfoCode) int {
+	if infoCode != OutboundRequest {
+		return 0
+	}
+	switch typeId {
+	case ReadTypeID, NonIncrementalReadTypeID, ConfigurationSpaceRead:
+		return 1
+	case WriteTypeID, NonIncrementalWriteTypeID, ConfigurationSpaceWrite:
+		return 1 + int(words)
+	case RMWbitsTypeID:
+		return 3
+	case RMWsumTypeID:
+		return 2
+	}
+	return 0
+}
+
+// State of the input stream, the byte order of the client is updated when a
+// packet header is found. A transaction header of another protocol version is
+// garbage, IPBUS_ISTREAM_ERR, and the stream has to be resynchronised.
+func streamState(c *streamClient) int {
+	if c.words() == 0 {
+		return IPBUS_ISTREAM_EMPTY
+	}
+	isPkt := detectPacketHeader(binary.BigEndian.Uint32(c.input))
+	if isPkt != 0 {
+		c.swapbytes = isPkt == IPBUS_ISTREAM_PACKET_SWP_ORD
+		c.resync = false
+		return isPkt
+	}
+	th := c.word(0)
+	if c.resync || th>>28 != IPbusProtocolVersion {
+		return IPBUS_ISTREAM_ERR
+	}
+	size := requestPayloadSize(uint8(th>>8), IPbusTransactionTypeID((th>>4)&0xf), IPbusInfoCode(th&0xf))
+	if c.words() >= 1+size {
+		return IPBUS_ISTREAM_FULL_TRANS
+	}
+	return IPBUS_ISTREAM_PARTIAL_TRANS
+}
+
+// transactionHandler executes the request transactions received by a target
+type transactionHandler interface {
+	handleTransaction(req *IPbusRequest) IPbusResponse
+}
+
+// Decode the full request transaction at the head of the input stream and
+// consume it. size is the number of payload words, zero for headers that are
+// not requests or of an unknown transaction type.
+func decodeTransactionStream(c *streamClient) (req IPbusRequest, size int) {
+	th := c.word(0)
+	req = IPbusRequest{
+		id:       IPbusTransactionID((th >> 16) & 0xfff),
+		words:    uint8(th >> 8),
+		typeId:   IPbusTransactionTypeID((th >> 4) & 0xf),
+		infoCode: IPbusInfoCode(th & 0xf),
+		th:       IPbusTransactionHeader(th),
+	}
+	size = requestPayloadSize(req.words, req.typeId, req.infoCode)
+	if size > 0 {
+		req.addr = BaseAddress(c.word(1))
+		for i := 2; i <= size; i++ {
+			req.data = append(req.data, IPbusWord(c.word(i)))
+		}
+	}
+	c.input = c.input[4*(1+size):]
+	return req, size
+}
+
+// Response to a header that is not a request
+func badHeader(req *IPbusRequest) IPbusResponse {
+	return IPbusResponse{id: req.id, words: req.words, typeId: req.typeId, infoCode: BadHeader}
+}
+
+// Append the response transaction to the output stream
+func pushResponse(c *streamClient, resp *IPbusResponse) {
+	c.push(IPbusProtocolVersion<<28 | uint32(resp.id&0xfff)<<16 | uint32(resp.words)<<8 |
+		uint32(resp.typeId&0xf)<<4 | uint32(resp.infoCode&0xf))
+	for _, v := range resp.data {
+		c.push(uint32(v))
+	}
+}
+
+// Decode the full request transaction at the head of the input stream, hand
+// it to h and encode the response. Returns the number of words consumed.
+func handleTransactionStream(c *streamClient, h transactionHandler) int {
+	req, size := decodeTransactionStream(c)
+	var resp IPbusResponse
+	if size == 0 {
+		// Not a request, or an unknown transaction type
+		resp = badHeader(&req)
+	} else {
+		resp = h.handleTransaction(&req)
+	}
+	pushResponse(c, &resp)
+	return 1 + size
+}
+
+// Drop the words of the input stream up to the next packet header, returns
+// the number of words dropped. When the header has not arrived yet the words
+// received next are dropped too.
+func resyncStream(c *streamClient) (n int) {
+	c.resync = true
+	for c.words() > 0 && detectPacketHeader(binary.BigEndian.Uint32(c.input)) == 0 {
+		c.input = c.input[4:]
+		n++
+	}
+	return n
+}
 
-	return n, err
+// Process the data received from a client: packet headers are echoed and
+// every complete transaction is handed to h, the replies are appended to the
+// client output stream. Partial transactions are left in the input stream
+// until more data arrives, garbage is dropped up to the next packet header.
+// Returns the number of words processed.
+func processInputStream(c *streamClient, h transactionHandler) (n int) {
+	for {
+		switch streamState(c) {
+		case IPBUS_ISTREAM_FULL_TRANS:
+			n += handleTransactionStream(c, h)
+		case IPBUS_ISTREAM_PACKET, IPBUS_ISTREAM_PACKET_SWP_ORD:
+			// by definition the header is in the correct endianness for the client
+			c.output = append(c.output, c.input[:4]...)
+			c.input = c.input[4:]
+			n++
+		case IPBUS_ISTREAM_ERR:
+			n += resyncStream(c)
+		default:
+			// wait for more data
+			return n
+		}
+	}
 }
@@ -0,0 +1,72 @@
+// GoIPbus incremental input stream parser
+
+package goipbus
+
+import (
+	"errors"
+)
+
+// ErrStreamState is returned when the head of the stream is not what was asked for
+var ErrStreamState = errors.New("IPbus stream state does not allow the operation")
+
+// StreamParser splits an IPbus request stream, as received from a TCP
+// connection or a serial line, into packet headers and transactions. It is
+// fed chunks of any size and keeps the incomplete words and transactions
+// until the rest arrives, as the input buffer of a softipbus client.
+type StreamParser struct {
+	c streamClient
+}
+
+// Write appends a chunk of the stream, it never fails
+func (p *StreamParser) Write(b []byte) (n int, err error) {
+	p.c.input = append(p.c.input, b...)
+	return len(b), nil
+}
+
+// Buffered returns the number of bytes received and not consumed yet
+func (p *StreamParser) Buffered() int {
+	return len(p.c.input)
+}
+
+// State reports what is at the head of the stream, one of the IPBUS_ISTREAM_*
+// states. A packet header sets the byte order of the transactions following
+// it; IPBUS_ISTREAM_ERR means garbage to be dropped with Resync.
+func (p *StreamParser) State() int {
+	return streamState(&p.c)
+}
+
+// Swapped reports whether the stream has the opposite byte order, as told by
+// the last packet header
+func (p *StreamParser) Swapped() bool {
+	return p.c.swapbytes
+}
+
+// PacketHeader consumes the packet header at the head of the stream
+func (p *StreamParser) PacketHeader() (ph IPbusPacketHeader, err error) {
+	switch p.State() {
+	case IPBUS_ISTREAM_PACKET, IPBUS_ISTREAM_PACKET_SWP_ORD:
+	default:
+		return 0, ErrStreamState
+	}
+	ph = IPbusPacketHeader(p.c.word(0))
+	p.c.input = p.c.input[4:]
+	return ph, nil
+}
+
+// Transaction consumes the full transaction at the head of the stream.
+// Headers that are not requests, or of an unknown transaction type, are
+// returned without payload.
+func (p *StreamParser) Transaction() (req IPbusRequest, err error) {
+	if p.State() != IPBUS_ISTREAM_FULL_TRANS {
+		return req, ErrStreamState
+	}
+	req, _ = decodeTransactionStream(&p.c)
+	return req, nil
+}
+
+// Resync drops the words up to the next packet header and returns the number
+// of bytes dropped. Until that header arrives the stream stays in the
+// IPBUS_ISTREAM_ERR state.
+func (p *StreamParser) Resync() int {
+	return 4 * resyncStream(&p.c)
+}
@@ -0,0 +1,124 @@
+package goipbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestStreamParserStates(t *testing.T) {
+	// As test_ipbus_stream_state in softipbus tests/serialization.c
+	p := new(StreamParser)
+	p.Write(wordBytes(0x20beeff2, 0xbadd))
+	if s := p.State(); s != IPBUS_ISTREAM_PACKET || p.Swapped() {
+		t.Errorf("Expected stream state %v, generated %v\n", IPBUS_ISTREAM_PACKET, s)
+	}
+	ph, err := p.PacketHeader()
+	if err != nil || ph.ID() != 0xbeef {
+		t.Errorf("Expected packet ID 0xbeef, generated %#x %v\n", ph, err)
+	}
+	if s := p.State(); s != IPBUS_ISTREAM_ERR {
+		t.Errorf("Expected stream state %v, generated %v\n", IPBUS_ISTREAM_ERR, s)
+	}
+	if n := p.Resync(); n != 4 {
+		t.Errorf("Expected 4 bytes dropped, generated %v\n", n)
+	}
+
+	p = new(StreamParser)
+	p.Write(wordBytes(0x2eef020f, 0xdeadbeef))
+	if s := p.State(); s != IPBUS_ISTREAM_FULL_TRANS {
+		t.Errorf("Expected stream state %v, generated %v\n", IPBUS_ISTREAM_FULL_TRANS, s)
+	}
+	req, err := p.Transaction()
+	if err != nil || req.id != 0xeef || req.typeId != ReadTypeID || req.words != 2 || uint32(req.addr) != 0xdeadbeef {
+		t.Errorf("Expected read of 2 words at 0xdeadbeef, generated %+v %v\n", req, err)
+	}
+	p.Write(wordBytes(0x2eef081f))
+	if s := p.State(); s != IPBUS_ISTREAM_PARTIAL_TRANS {
+		t.Errorf("Expected stream state %v, generated %v\n", IPBUS_ISTREAM_PARTIAL_TRANS, s)
+	}
+	if _, err = p.Transaction(); err != ErrStreamState {
+		t.Errorf("Expected %v, generated %v\n", ErrStreamState, err)
+	}
+	p = new(StreamParser)
+	if s := p.State(); s != IPBUS_ISTREAM_EMPTY {
+		t.Errorf("Expected stream state %v, generated %v\n", IPBUS_ISTREAM_EMPTY, s)
+	}
+}
+
+func TestStreamParserChunks(t *testing.T) {
+	// little-endian packet header, write of 2 words at 0x4, RMWbits at 0x8
+	var in []byte
+	for _, w := range []uint32{0x200001f0, 0x2001021f, 0x4, 0xa, 0xb, 0x2002014f, 0x8, 0xff, 0x1} {
+		in = binary.LittleEndian.AppendUint32(in, w)
+	}
+	p := new(StreamParser)
+	var headers []IPbusPacketHeader
+	var reqs []IPbusRequest
+	for _, b := range in {
+		p.Write([]byte{b})
+		for {
+			s := p.State()
+			if s == IPBUS_ISTREAM_PACKET_SWP_ORD {
+				ph, _ := p.PacketHeader()
+				headers = append(headers, ph)
+			} else if s == IPBUS_ISTREAM_FULL_TRANS {
+				req, _ := p.Transaction()
+				reqs = append(reqs, req)
+			} else if s == IPBUS_ISTREAM_EMPTY || s == IPBUS_ISTREAM_PARTIAL_TRANS {
+				break
+			} else {
+				t.Fatalf("Unexpected stream state %v\n", s)
+			}
+		}
+	}
+	if len(headers) != 1 || headers[0] != 0x200001f0 || !p.Swapped() {
+		t.Errorf("Expected swapped header 0x200001f0, generated %#x\n", headers)
+	}
+	if len(reqs) != 2 || reqs[0].typeId != WriteTypeID || reqs[0].addr != 0x4 || len(reqs[0].data) != 2 ||
+		reqs[0].data[1] != 0xb || reqs[1].typeId != RMWbitsTypeID || reqs[1].data[1] != 0x1 {
+		t.Errorf("Expected a write and a RMWbits, generated %+v\n", reqs)
+	}
+	if p.Buffered() != 0 {
+		t.Errorf("Expected empty stream, generated %v bytes\n", p.Buffered())
+	}
+}
+
+func TestStreamParserResync(t *testing.T) {
+	p := new(StreamParser)
+	// garbage then a transaction, both dropped until the packet header
+	p.Write(wordBytes(0xdeadbeef, 0x2000010f))
+	p.Write([]byte{0x0, 0x0})
+	if s := p.State(); s != IPBUS_ISTREAM_ERR {
+		t.Fatalf("Expected stream state %v, generated %v\n", IPBUS_ISTREAM_ERR, s)
+	}
+	if n := p.Resync(); n != 8 {
+		t.Errorf("Expected 8 bytes dropped, generated %v\n", n)
+	}
+	p.Write([]byte{0x0, 0x1})
+	if s := p.State(); s != IPBUS_ISTREAM_ERR {
+		t.Errorf("Expected stream state %v, generated %v\n", IPBUS_ISTREAM_ERR, s)
+	}
+	p.Resync()
+	p.Write(wordBytes(0x200002f0, 0x2000010f, 0x1))
+	if s := p.State(); s != IPBUS_ISTREAM_PACKET {
+		t.Fatalf("Expected stream state %v, generated %v\n", IPBUS_ISTREAM_PACKET, s)
+	}
+	p.PacketHeader()
+	if s := p.State(); s != IPBUS_ISTREAM_FULL_TRANS {
+		t.Errorf("Expected stream state %v, generated %v\n", IPBUS_ISTREAM_FULL_TRANS, s)
+	}
+}
+
+func TestProcessInputStreamGarbage(t *testing.T) {
+	mem := NewRAM(0x10)
+	mem[0x1] = 0xcafe
+	c := new(streamClient)
+	c.input = wordBytes(0x200000f0, 0x0badf00d, 0x2000010f, 0x1, 0x200001f0, 0x2001010f, 0x1)
+	processInputStream(c, NewServer(mem))
+
+	expected := wordBytes(0x200000f0, 0x200001f0, 0x20010100, 0xcafe)
+	if !bytes.Equal(c.output, expected) {
+		t.Errorf("Expected %#x, generated %#x\n", expected, c.output)
+	}
+}
@@ -0,0 +1,160 @@
+// GoIPbus TCP transport
+
+package goipbus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// URI scheme of the IPbus 2.0 TCP transport
+const TCPScheme = "ipbustcp-2.0"
+
+// TCPClient sends IPbus control packets to a single target over a TCP stream,
+// as served by softipbus serve-tcp.
+//
+// The stream carries bare control packets: the target echoes the packet
+// header as soon as it is received and then answers each transaction in turn,
+// so the reply is framed by walking the transaction headers. Dispatch calls
+// from several goroutines are serialised.
+type TCPClient struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	r       *bufio.Reader
+	session *Session
+	// Timeout bounds the wait for each reply, DefaultTimeout if zero
+	Timeout time.Duration
+}
+
+// DialTCP connects to an IPbus TCP target, uri is either
+// ipbustcp-2.0://host:port or a bare host:port
+func DialTCP(uri string) (*TCPClient, error) {
+	scheme, host, err := splitURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	if scheme != "" && scheme != TCPScheme {
+		return nil, errSchemeNotSupported
+	}
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	return &TCPClient{conn: conn, r: bufio.NewReader(conn), session: NewSession(), Timeout: DefaultTimeout}, nil
+}
+
+// Dispatch sends the control packet and decodes the reply from the stream
+func (c *TCPClient) Dispatch(cp *IPbusControlPacket) (resps []IPbusResponse, err error) {
+	return c.DispatchContext(context.Background(), cp)
+}
+
+// DispatchContext is Dispatch aborted when ctx is done. A reply interrupted
+// by a timeout or a cancellation leaves the stream out of step: the client
+// should be closed.
+func (c *TCPClient) DispatchContext(ctx context.Context, cp *IPbusControlPacket) (resps []IPbusResponse, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err = contextDone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, cp.RequestSize())
+	n, err := c.session.Encode(cp, b)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.conn.SetDeadline(contextDeadline(ctx, c.Timeout))
+	if err != nil {
+		return nil, err
+	}
+	stop := watchContext(ctx, c.conn.SetDeadline)
+	defer stop()
+	_, err = c.conn.Write(b[:n])
+	if err != nil {
+		return nil, contextError(ctx, streamError(err))
+	}
+
+	reply, err := readReply(c.r, cp.Len())
+	if err != nil {
+		return nil, contextError(ctx, streamError(err))
+	}
+	ph, resps, err := DecodeControlPacket(reply)
+	if err != nil {
+		return resps, err
+	}
+	if ph != cp.ph {
+		return resps, errReplyMismatch
+	}
+	return resps, cp.checkReply(resps)
+}
+
+// Session returns the ID sequences used with the target
+func (c *TCPClient) Session() *Session {
+	return c.session
+}
+
+// Close closes the TCP connection
+func (c *TCPClient) Close() error {
+	return c.conn.Close()
+}
+
+// Read a reply packet header followed by ntrans transaction responses, in the
+// byte order of the header.
+// io.ReadFull accumulates partial reads until each word is complete, like the
+// ByteBuffer shim of softipbus.
+func readReply(r io.Reader, ntrans int) (b []byte, err error) {
+	b = make([]byte, 4)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if packetSwapped(b) {
+		order = binary.LittleEndian
+	}
+	trans, err := readTransactions(r, ntrans, order)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, trans...), nil
+}
+
+// Read ntrans transaction responses, each sized from its own header read in
+// the given byte order
+func readTransactions(r io.Reader, ntrans int, order binary.ByteOrder) (b []byte, err error) {
+	for i := 0; i < ntrans; i++ {
+		th := make([]byte, 4)
+		_, err = io.ReadFull(r, th)
+		if err != nil {
+			return nil, err
+		}
+		word := order.Uint32(th)
+		size := responsePayloadSize(uint8(word>>8), IPbusTransactionTypeID((word>>4)&0xf), IPbusInfoCode(word&0xf))
+		payload := make([]byte, 4*size)
+		_, err = io.ReadFull(r, payload)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, th...)
+		b = append(b, payload...)
+	}
+	return b, nil
+}
+
+// Map stream deadline errors to ErrTimeout
+func streamError(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ErrTimeout
+	}
+	if err == io.EOF {
+		return ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+package goipbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Minimal stream target mimicking softipbus serve-tcp: the packet header is
+// echoed on arrival and each transaction is answered as soon as it is
+// complete. Replies are written a few bytes at a time to force partial reads
+// on the client.
+func tcpStandIn(t *testing.T, mem map[BaseAddress]IPbusWord) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go tcpStandInServe(conn, mem)
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func tcpStandInServe(conn net.Conn, mem map[BaseAddress]IPbusWord) {
+	defer conn.Close()
+	readWord := func() (uint32, error) {
+		b := make([]byte, 4)
+		_, err := io.ReadFull(conn, b)
+		return binary.BigEndian.Uint32(b), err
+	}
+	writeWords := func(word []uint32) {
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.BigEndian, word)
+		for b := buf.Bytes(); len(b) > 0; b = b[1:] {
+			conn.Write(b[:1])
+		}
+	}
+	for {
+		word, err := readWord()
+		if err != nil {
+			return
+		}
+		// Packet header
+		if word&0xf00000f0 == 0x200000f0 {
+			writeWords([]uint32{word})
+			continue
+		}
+		req := []uint32{word}
+		for len(req) < standInRequestSize(word) {
+			w, err := readWord()
+			if err != nil {
+				return
+			}
+			req = append(req, w)
+		}
+		reply, _ := standInTransaction(req, mem)
+		time.Sleep(time.Millisecond)
+		writeWords(reply)
+	}
+}
+
+func TestTCPClientDispatch(t *testing.T) {
+	mem := map[BaseAddress]IPbusWord{0x100: 0xa, 0x101: 0xb}
+	addr, stop := tcpStandIn(t, mem)
+	defer stop()
+
+	c, err := Open(TCPScheme + "://" + addr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+
+	for k := 0; k < 2; k++ {
+		cp := new(IPbusControlPacket)
+		cp.Append(NewWriteRequest(0x200, []IPbusWord{0x1, 0x2, 0x3}))
+		cp.Append(NewReadRequest(0x100, 2))
+		cp.Append(NewRMWbitsRequest(0x101, 0x0f, 0x30))
+		resps, err := c.Dispatch(cp)
+		if err != nil {
+			t.Fatalf("Error %v\n", err)
+		}
+		for i := range resps {
+			if resps[i].id != cp.reqs[i].id {
+				t.Errorf("Expected transaction ID %#x, generated %#x\n", cp.reqs[i].id, resps[i].id)
+			}
+		}
+		// The RMWbits of the first packet changes the second read
+		expected := [][]IPbusWord{{0xa, 0xb}, {0xa, 0x3b}}[k]
+		d := resps[1].Data()
+		if len(d) != 2 || d[0] != expected[0] || d[1] != expected[1] {
+			t.Errorf("Expected read %#x, generated %#x\n", expected, d)
+		}
+		if peek(mem, 0x202) != 0x3 {
+			t.Errorf("Expected memory 0x3, generated %#x\n", peek(mem, 0x202))
+		}
+	}
+	if peek(mem, 0x101) != 0x3b {
+		t.Errorf("Expected RMWbits result 0x3b, generated %#x\n", peek(mem, 0x101))
+	}
+}
+
+func TestTCPClientTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	c, err := DialTCP(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+	c.Timeout = 50 * time.Millisecond
+
+	_, err = c.Dispatch(new(IPbusControlPacket))
+	if err != ErrTimeout {
+		t.Errorf("Expected %v, generated %v\n", ErrTimeout, err)
+	}
+}
+
+func TestTCPClientContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	c, err := DialTCP(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+	c.Timeout = 10 * time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = c.DispatchContext(ctx, new(IPbusControlPacket))
+	if err != context.DeadlineExceeded || time.Since(start) > time.Second {
+		t.Errorf("Expected %v, generated %v after %v\n", context.DeadlineExceeded, err, time.Since(start))
+	}
+}
@@ -0,0 +1,230 @@
+// GoIPbus block transfers
+
+package goipbus
+
+import (
+	"context"
+	"errors"
+)
+
+// The Words field is 8 bits wide, longer transfers are split at the software level
+const maxTransactionWords = 0xff
+
+// ErrTransactionSize is returned when a single transaction request carries more than 255 words
+var ErrTransactionSize = errors.New("IPbus transaction larger than 255 words")
+
+// ErrBlockSize is returned when a block read is given a negative size
+var ErrBlockSize = errors.New("IPbus negative block size")
+
+// Split a block of size words into transactions of at most maxTransactionWords,
+// calling add with the word offset and length of each one
+func splitBlock(size int, add func(off, n int)) {
+	for off := 0; off < size; off += maxTransactionWords {
+		n := size - off
+		if n > maxTransactionWords {
+			n = maxTransactionWords
+		}
+		add(off, n)
+	}
+}
+
+// NewBlockReadRequests returns the read transactions (Type ID = 0x0) covering
+// size words starting at addr
+func NewBlockReadRequests(addr BaseAddress, size int) (reqs []*IPbusRequest) {
+	splitBlock(size, func(off, n int) {
+		reqs = append(reqs, NewReadRequest(addr+BaseAddress(off), uint8(n)))
+	})
+	return reqs
+}
+
+// NewBlockNonIncrementalReadRequests returns the non-incrementing read
+// transactions (Type ID = 0x2) reading size words from the FIFO at addr
+func NewBlockNonIncrementalReadRequests(addr BaseAddress, size int) (reqs []*IPbusRequest) {
+	splitBlock(size, func(off, n int) {
+		reqs = append(reqs, NewNonIncrementalReadRequest(addr, uint8(n)))
+	})
+	return reqs
+}
+
+// NewBlockWriteRequests returns the write transactions (Type ID = 0x1)
+// writing data starting at addr
+func NewBlockWriteRequests(addr BaseAddress, data []IPbusWord) (reqs []*IPbusRequest) {
+	splitBlock(len(data), func(off, n int) {
+		reqs = append(reqs, NewWriteRequest(addr+BaseAddress(off), data[off:off+n]))
+	})
+	return reqs
+}
+
+// NewBlockNonIncrementalWriteRequests returns the non-incrementing write
+// transactions (Type ID = 0x3) pushing data into the FIFO at addr
+func NewBlockNonIncrementalWriteRequests(addr BaseAddress, data []IPbusWord) (reqs []*IPbusRequest) {
+	splitBlock(len(data), func(off, n int) {
+		reqs = append(reqs, NewNonIncrementalWriteRequest(addr, data[off:off+n]))
+	})
+	return reqs
+}
+
+// NewBlockConfigurationSpaceReadRequests returns the configuration space read
+// transactions (Type ID = 0x6) covering size words starting at addr
+func NewBlockConfigurationSpaceReadRequests(addr BaseAddress, size int) (reqs []*IPbusRequest) {
+	splitBlock(size, func(off, n int) {
+		reqs = append(reqs, NewConfigurationSpaceReadRequest(addr+BaseAddress(off), uint8(n)))
+	})
+	return reqs
+}
+
+// NewBlockConfigurationSpaceWriteRequests returns the configuration space
+// write transactions (Type ID = 0x7) writing data starting at addr
+func NewBlockConfigurationSpaceWriteRequests(addr BaseAddress, data []IPbusWord) (reqs []*IPbusRequest) {
+	splitBlock(len(data), func(off, n int) {
+		reqs = append(reqs, NewConfigurationSpaceWriteRequest(addr+BaseAddress(off), data[off:off+n]))
+	})
+	return reqs
+}
+
+// Pack the requests into as few control packets as possible, dispatch them in
+// order and return all the responses
+func dispatchRequests(c IPbusClient, reqs []*IPbusRequest) (resps []IPbusResponse, err error) {
+	return dispatchPackets(reqs, c.Dispatch)
+}
+
+// dispatchRequests aborted when ctx is done
+func dispatchRequestsContext(ctx context.Context, c IPbusClient, reqs []*IPbusRequest) (resps []IPbusResponse, err error) {
+	return dispatchPackets(reqs, func(cp *IPbusControlPacket) ([]IPbusResponse, error) {
+		return c.DispatchContext(ctx, cp)
+	})
+}
+
+func dispatchPackets(reqs []*IPbusRequest, dispatch func(cp *IPbusControlPacket) ([]IPbusResponse, error)) (resps []IPbusResponse, err error) {
+	cps, err := PackRequests(reqs)
+	if err != nil {
+		return nil, err
+	}
+	for _, cp := range cps {
+		r, err := dispatch(cp)
+		if err != nil {
+			return nil, err
+		}
+		resps = append(resps, r...)
+	}
+	return resps, nil
+}
+
+// Concatenate the data of the responses in order
+func joinResponses(resps []IPbusResponse, size int) []IPbusWord {
+	data := make([]IPbusWord, 0, size)
+	for i := range resps {
+		data = append(data, resps[i].data...)
+	}
+	return data
+}
+
+// ReadBlock reads size words starting at addr
+func ReadBlock(c IPbusClient, addr BaseAddress, size int) ([]IPbusWord, error) {
+	if size < 0 {
+		return nil, ErrBlockSize
+	}
+	resps, err := dispatchRequests(c, NewBlockReadRequests(addr, size))
+	if err != nil {
+		return nil, err
+	}
+	return joinResponses(resps, size), nil
+}
+
+// ReadBlockContext is ReadBlock aborted when ctx is done
+func ReadBlockContext(ctx context.Context, c IPbusClient, addr BaseAddress, size int) ([]IPbusWord, error) {
+	if size < 0 {
+		return nil, ErrBlockSize
+	}
+	resps, err := dispatchRequestsContext(ctx, c, NewBlockReadRequests(addr, size))
+	if err != nil {
+		return nil, err
+	}
+	return joinResponses(resps, size), nil
+}
+
+// NonIncrementalReadBlock reads size words from the FIFO at addr
+func NonIncrementalReadBlock(c IPbusClient, addr BaseAddress, size int) ([]IPbusWord, error) {
+	if size < 0 {
+		return nil, ErrBlockSize
+	}
+	resps, err := dispatchRequests(c, NewBlockNonIncrementalReadRequests(addr, size))
+	if err != nil {
+		return nil, err
+	}
+	return joinResponses(resps, size), nil
+}
+
+// NonIncrementalReadBlockContext is NonIncrementalReadBlock aborted when ctx is done
+func NonIncrementalReadBlockContext(ctx context.Context, c IPbusClient, addr BaseAddress, size int) ([]IPbusWord, error) {
+	if size < 0 {
+		return nil, ErrBlockSize
+	}
+	resps, err := dispatchRequestsContext(ctx, c, NewBlockNonIncrementalReadRequests(addr, size))
+	if err != nil {
+		return nil, err
+	}
+	return joinResponses(resps, size), nil
+}
+
+// WriteBlock writes data starting at addr
+func WriteBlock(c IPbusClient, addr BaseAddress, data []IPbusWord) error {
+	_, err := dispatchRequests(c, NewBlockWriteRequests(addr, data))
+	return err
+}
+
+// WriteBlockContext is WriteBlock aborted when ctx is done
+func WriteBlockContext(ctx context.Context, c IPbusClient, addr BaseAddress, data []IPbusWord) error {
+	_, err := dispatchRequestsContext(ctx, c, NewBlockWriteRequests(addr, data))
+	return err
+}
+
+// NonIncrementalWriteBlock pushes data into the FIFO at addr
+func NonIncrementalWriteBlock(c IPbusClient, addr BaseAddress, data []IPbusWord) error {
+	_, err := dispatchRequests(c, NewBlockNonIncrementalWriteRequests(addr, data))
+	return err
+}
+
+// NonIncrementalWriteBlockContext is NonIncrementalWriteBlock aborted when ctx is done
+func NonIncrementalWriteBlockContext(ctx context.Context, c IPbusClient, addr BaseAddress, data []IPbusWord) error {
+	_, err := dispatchRequestsContext(ctx, c, NewBlockNonIncrementalWriteRequests(addr, data))
+	return err
+}
+
+// ReadConfigurationSpace reads size words of the target configuration space
+// starting at addr
+func ReadConfigurationSpace(c IPbusClient, addr BaseAddress, size int) ([]IPbusWord, error) {
+	if size < 0 {
+		return nil, ErrBlockSize
+	}
+	resps, err := dispatchRequests(c, NewBlockConfigurationSpaceReadRequests(addr, size))
+	if err != nil {
+		return nil, err
+	}
+	return joinResponses(resps, size), nil
+}
+
+// ReadConfigurationSpaceContext is ReadConfigurationSpace aborted when ctx is done
+func ReadConfigurationSpaceContext(ctx context.Context, c IPbusClient, addr BaseAddress, size int) ([]IPbusWord, error) {
+	if size < 0 {
+		return nil, ErrBlockSize
+	}
+	resps, err := dispatchRequestsContext(ctx, c, NewBlockConfigurationSpaceReadRequests(addr, size))
+	if err != nil {
+		return nil, err
+	}
+	return joinResponses(resps, size), nil
+}
+
+// WriteConfigurationSpace writes data into the target configuration space
+// starting at addr
+func WriteConfigurationSpace(c IPbusClient, addr BaseAddress, data []IPbusWord) error {
+	_, err := dispatchRequests(c, NewBlockConfigurationSpaceWriteRequests(addr, data))
+	return err
+}
+
+// WriteConfigurationSpaceContext is WriteConfigurationSpace aborted when ctx is done
+func WriteConfigurationSpaceContext(ctx context.Context, c IPbusClient, addr BaseAddress, data []IPbusWord) error {
+	_, err := dispatchRequestsContext(ctx, c, NewBlockConfigurationSpaceWriteRequests(addr, data))
+	return err
+}
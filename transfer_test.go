@@ -0,0 +1,206 @@
+package goipbus
+
+import (
+	"context"
+	"testing"
+)
+
+// IPbusClient wrapper recording the traffic of each dispatched packet
+type countingClient struct {
+	IPbusClient
+	packets  int
+	maxWords uint8
+}
+
+func (c *countingClient) Dispatch(cp *IPbusControlPacket) ([]IPbusResponse, error) {
+	c.packets++
+	for i := range cp.reqs {
+		if cp.reqs[i].words > c.maxWords {
+			c.maxWords = cp.reqs[i].words
+		}
+	}
+	return c.IPbusClient.Dispatch(cp)
+}
+
+func TestNewBlockRequests(t *testing.T) {
+	reqs := NewBlockReadRequests(0x1000, 600)
+	if len(reqs) != 3 {
+		t.Fatalf("Expected 3 requests, generated %v\n", len(reqs))
+	}
+	addrs := []BaseAddress{0x1000, 0x1000 + 255, 0x1000 + 510}
+	words := []uint8{255, 255, 90}
+	for i, rq := range reqs {
+		if rq.addr != addrs[i] || rq.words != words[i] || rq.typeId != ReadTypeID {
+			t.Errorf("Expected read %#x of %v words, generated %#x of %v\n", addrs[i], words[i], rq.addr, rq.words)
+		}
+	}
+
+	data := make([]IPbusWord, 256)
+	reqs = NewBlockNonIncrementalWriteRequests(0x100, data)
+	if len(reqs) != 2 || reqs[1].addr != 0x100 || reqs[1].words != 1 || len(reqs[1].data) != 1 {
+		t.Errorf("Expected 2 non-incrementing writes at 0x100, generated %v\n", len(reqs))
+	}
+
+	if len(NewBlockReadRequests(0x0, 0)) != 0 {
+		t.Errorf("Expected no request for an empty block\n")
+	}
+
+	cp := new(IPbusControlPacket)
+	err := cp.Append(NewWriteRequest(0x0, data))
+	if err != ErrTransactionSize {
+		t.Errorf("Expected %v, generated %v\n", ErrTransactionSize, err)
+	}
+}
+
+func TestBlockTransfer(t *testing.T) {
+	mem := map[BaseAddress]IPbusWord{}
+	addr, stop := udpStandIn(t, mem)
+	defer stop()
+	udp, err := DialUDP(addr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer udp.Close()
+	c := &countingClient{IPbusClient: udp}
+
+	data := make([]IPbusWord, 1000)
+	for i := range data {
+		data[i] = IPbusWord(i * 3)
+	}
+	err = WriteBlock(c, 0x200, data)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if c.maxWords != maxTransactionWords || c.packets < 3 {
+		t.Errorf("Expected split transfers, generated %v packets of up to %v words\n", c.packets, c.maxWords)
+	}
+
+	c.packets = 0
+	rd, err := ReadBlock(c, 0x200, len(data))
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if len(rd) != len(data) {
+		t.Fatalf("Expected %v words, generated %v\n", len(data), len(rd))
+	}
+	for i := range data {
+		if rd[i] != data[i] {
+			t.Fatalf("Expected word %v = %#x, generated %#x\n", i, data[i], rd[i])
+		}
+	}
+	// A single 255 word read response fills a packet
+	if c.packets != 4 {
+		t.Errorf("Expected 4 packets, generated %v\n", c.packets)
+	}
+
+	err = NonIncrementalWriteBlock(c, 0x100, data[:300])
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if peek(mem, 0x100) != data[299] || peek(mem, 0x101) != 0 {
+		t.Errorf("Expected FIFO word %#x, generated %#x\n", data[299], peek(mem, 0x100))
+	}
+	rd, err = NonIncrementalReadBlock(c, 0x100, 300)
+	if err != nil || len(rd) != 300 || rd[299] != data[299] {
+		t.Errorf("Expected 300 FIFO words, generated %v (%v)\n", len(rd), err)
+	}
+}
+
+func TestConfigurationSpace(t *testing.T) {
+	addr, stop := udpStandIn(t, map[BaseAddress]IPbusWord{})
+	defer stop()
+	c, err := DialUDP(addr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+
+	rd, err := ReadConfigurationSpace(c, 0x0, 2)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if len(rd) != 2 || rd[0] != 0x0a0b0c0d || rd[1] != 0x0e0f {
+		t.Errorf("Expected configuration 0xa0b0c0d 0xe0f, generated %#x\n", rd)
+	}
+
+	err = WriteConfigurationSpace(c, 0x10, []IPbusWord{0x5, 0x6})
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	rd, err = ReadConfigurationSpace(c, 0x10, 2)
+	if err != nil || len(rd) != 2 || rd[0] != 0x5 || rd[1] != 0x6 {
+		t.Errorf("Expected configuration 0x5 0x6, generated %#x (%v)\n", rd, err)
+	}
+}
+
+func TestBlockTransferContext(t *testing.T) {
+	mem := map[BaseAddress]IPbusWord{}
+	addr, stop := udpStandIn(t, mem)
+	defer stop()
+	c, err := DialUDP(addr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	data := []IPbusWord{0x1, 0x2, 0x3}
+	if err := WriteBlockContext(ctx, c, 0x200, data); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	rd, err := ReadBlockContext(ctx, c, 0x200, len(data))
+	if err != nil || len(rd) != 3 || rd[2] != 0x3 {
+		t.Errorf("Expected 0x1 0x2 0x3, generated %#x (%v)\n", rd, err)
+	}
+	if err := NonIncrementalWriteBlockContext(ctx, c, 0x100, data); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	rd, err = NonIncrementalReadBlockContext(ctx, c, 0x100, 2)
+	if err != nil || len(rd) != 2 || rd[1] != 0x3 {
+		t.Errorf("Expected FIFO words 0x3 0x3, generated %#x (%v)\n", rd, err)
+	}
+	if err := WriteConfigurationSpaceContext(ctx, c, 0x10, data[:2]); err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	rd, err = ReadConfigurationSpaceContext(ctx, c, 0x10, 2)
+	if err != nil || len(rd) != 2 || rd[1] != 0x2 {
+		t.Errorf("Expected configuration 0x1 0x2, generated %#x (%v)\n", rd, err)
+	}
+
+	// Nothing is sent once ctx is done
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := WriteBlockContext(cctx, c, 0x300, data); err != context.Canceled || peek(mem, 0x300) != 0 {
+		t.Errorf("Expected %v, generated %v\n", context.Canceled, err)
+	}
+	if _, err := ReadConfigurationSpaceContext(cctx, c, 0x0, 1); err != context.Canceled {
+		t.Errorf("Expected %v, generated %v\n", context.Canceled, err)
+	}
+}
+
+func TestBlockTransferSize(t *testing.T) {
+	addr, stop := udpStandIn(t, map[BaseAddress]IPbusWord{})
+	defer stop()
+	c, err := DialUDP(addr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	for _, read := range []func(BaseAddress, int) ([]IPbusWord, error){
+		func(a BaseAddress, n int) ([]IPbusWord, error) { return ReadBlock(c, a, n) },
+		func(a BaseAddress, n int) ([]IPbusWord, error) { return NonIncrementalReadBlock(c, a, n) },
+		func(a BaseAddress, n int) ([]IPbusWord, error) { return ReadConfigurationSpace(c, a, n) },
+		func(a BaseAddress, n int) ([]IPbusWord, error) { return ReadBlockContext(ctx, c, a, n) },
+		func(a BaseAddress, n int) ([]IPbusWord, error) { return NonIncrementalReadBlockContext(ctx, c, a, n) },
+		func(a BaseAddress, n int) ([]IPbusWord, error) { return ReadConfigurationSpaceContext(ctx, c, a, n) },
+	} {
+		if _, err := read(0x10, -1); err != ErrBlockSize {
+			t.Errorf("Expected %v, generated %v\n", ErrBlockSize, err)
+		}
+		if rd, err := read(0x10, 0); err != nil || len(rd) != 0 {
+			t.Errorf("Expected empty block, generated %#x (%v)\n", rd, err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// GoIPbus UDP transport
+
+package goipbus
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// URI scheme of the IPbus 2.0 UDP transport
+const UDPScheme = "ipbusudp-2.0"
+
+// Default time to wait for the reply to a control packet
+const DefaultTimeout = time.Second
+
+// Largest datagram accepted from the target
+const maxDatagramSize = 65535
+
+// UDPClient sends IPbus control packets to a single target over UDP.
+//
+// Each call to Dispatch waits for the reply whose packet header matches the
+// request; any other datagram received in the meantime is discarded. The
+// client owns the session of its target, Dispatch calls from several
+// goroutines are serialised.
+//
+// Once EnableReliability has been called, a reply that does not arrive in time
+// is recovered through the IPbus reliability mechanism instead of failing.
+type UDPClient struct {
+	mu      sync.Mutex
+	conn    *net.UDPConn
+	session *Session
+	// Timeout bounds the wait for each reply, DefaultTimeout if zero
+	Timeout time.Duration
+	// Retries bounds the recovery attempts of a reliable session,
+	// DefaultRetries if zero
+	Retries int
+}
+
+// DialUDP connects to an IPbus UDP target, uri is either
+// ipbusudp-2.0://host:port or a bare host:port
+func DialUDP(uri string) (*UDPClient, error) {
+	scheme, host, err := splitURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	if scheme != "" && scheme != UDPScheme {
+		return nil, errSchemeNotSupported
+	}
+	raddr, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPClient{conn: conn, session: NewSession(), Timeout: DefaultTimeout}, nil
+}
+
+// Dispatch sends the control packet and decodes the matching reply
+func (c *UDPClient) Dispatch(cp *IPbusControlPacket) (resps []IPbusResponse, err error) {
+	return c.DispatchContext(context.Background(), cp)
+}
+
+// DispatchContext is Dispatch aborted when ctx is done. A reliable session
+// that cannot recover the reply returns a *TimeoutError telling whether the
+// request or the reply was lost. The recovery only starts once Timeout has
+// elapsed: a ctx deadline passing first returns context.DeadlineExceeded,
+// without telling what was lost.
+func (c *UDPClient) DispatchContext(ctx context.Context, cp *IPbusControlPacket) (resps []IPbusResponse, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err = contextDone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, cp.RequestSize())
+	n, err := c.session.Encode(cp, b)
+	if err != nil {
+		return nil, err
+	}
+	stop := watchContext(ctx, c.conn.SetReadDeadline)
+	defer stop()
+	_, err = c.conn.Write(b[:n])
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.receive(ctx, cp.ph)
+	if err == ErrTimeout && c.session.Reliable() {
+		retries := c.Retries
+		if retries == 0 {
+			retries = DefaultRetries
+		}
+		var lost error
+		for i := 0; i < retries && err == ErrTimeout; i++ {
+			reply, lost, err = c.recover(ctx, cp.ph, b[:n])
+		}
+		if err == ErrTimeout && lost != nil {
+			err = &TimeoutError{ID: cp.ph.ID(), Lost: lost}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, resps, err = DecodeControlPacket(reply)
+	if err != nil {
+		return resps, err
+	}
+	return resps, cp.checkReply(resps)
+}
+
+// Wait for the datagram starting with packet header ph
+func (c *UDPClient) receive(ctx context.Context, ph IPbusPacketHeader) (b []byte, err error) {
+	err = c.conn.SetReadDeadline(contextDeadline(ctx, c.Timeout))
+	if err != nil {
+		return nil, err
+	}
+	// ctx may have been done before the deadline was set
+	err = contextDone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b = make([]byte, maxDatagramSize)
+	for {
+		n, err := c.conn.Read(b)
+		if err != nil {
+			if cerr := contextDone(ctx); cerr != nil {
+				return nil, cerr
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, ErrTimeout
+			}
+			return nil, err
+		}
+		// Skip stale or unrelated datagrams
+		if n < 4 || readPacketHeader(b) != ph {
+			continue
+		}
+		return b[:n], nil
+	}
+}
+
+// Session returns the ID sequences used with the target
+func (c *UDPClient) Session() *Session {
+	return c.session
+}
+
+// Close closes the UDP socket
+func (c *UDPClient) Close() error {
+	return c.conn.Close()
+}
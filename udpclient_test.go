@@ -0,0 +1,251 @@
+package goipbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Addresses at or above standInBusLimit answer with a bus error
+const standInBusLimit BaseAddress = 0x10000
+
+// Configuration space of the stand-in targets
+var standInConfig = map[BaseAddress]IPbusWord{0x0: 0x0a0b0c0d, 0x1: 0x0e0f}
+
+// Guards the memory maps shared between the stand-in targets and the tests
+var standInMu sync.Mutex
+
+// Read a stand-in memory word from the test goroutine
+func peek(mem map[BaseAddress]IPbusWord, addr BaseAddress) IPbusWord {
+	standInMu.Lock()
+	defer standInMu.Unlock()
+	return mem[addr]
+}
+
+// Minimal UDP target used to exercise the client: it serves the mem map and
+// replies to every control packet it receives.
+func udpStandIn(t *testing.T, mem map[BaseAddress]IPbusWord) (addr string, stop func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	go func() {
+		b := make([]byte, maxDatagramSize)
+		for {
+			n, raddr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			// A stray datagram the client must ignore
+			conn.WriteToUDP([]byte{0xde, 0xad, 0xbe, 0xef}, raddr)
+			conn.WriteToUDP(standInReply(b[:n], mem), raddr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+// Execute the transactions of a request packet against mem
+func standInReply(b []byte, mem map[BaseAddress]IPbusWord) []byte {
+	word := make([]uint32, len(b)/4)
+	binary.Read(bytes.NewReader(b), binary.BigEndian, word)
+	out := []uint32{word[0]}
+	for i := 1; i+1 < len(word); {
+		reply, n := standInTransaction(word[i:], mem)
+		out = append(out, reply...)
+		i += n
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, out)
+	return buf.Bytes()
+}
+
+// Number of words of the request transaction starting with header th
+func standInRequestSize(th uint32) int {
+	words := int((th >> 8) & 0xff)
+	switch (th >> 4) & 0xf {
+	case 0x1, 0x3, 0x7:
+		return 2 + words
+	case 0x4:
+		return 4
+	case 0x5:
+		return 3
+	}
+	return 2
+}
+
+// Execute a single request transaction against mem, returns the reply words
+// and the number of request words consumed
+func standInTransaction(word []uint32, mem map[BaseAddress]IPbusWord) (reply []uint32, n int) {
+	standInMu.Lock()
+	defer standInMu.Unlock()
+	th := word[0]
+	words := (th >> 8) & 0xff
+	typeId := (th >> 4) & 0xf
+	addr := BaseAddress(word[1])
+	var data []uint32
+	switch typeId {
+	case 0x0, 0x2:
+		for j := uint32(0); j < words; j++ {
+			a := addr
+			if typeId == 0x0 {
+				a += BaseAddress(j)
+			}
+			data = append(data, uint32(mem[a]))
+		}
+	case 0x1, 0x3:
+		for j := uint32(0); j < words; j++ {
+			a := addr
+			if typeId == 0x1 {
+				a += BaseAddress(j)
+			}
+			mem[a] = IPbusWord(word[2+j])
+		}
+	case 0x4:
+		data = []uint32{uint32(mem[addr])}
+		mem[addr] = IPbusWord((data[0] & word[2]) | word[3])
+	case 0x5:
+		data = []uint32{uint32(mem[addr])}
+		mem[addr] = IPbusWord(data[0] + word[2])
+	case 0x6:
+		for j := uint32(0); j < words; j++ {
+			data = append(data, uint32(standInConfig[addr+BaseAddress(j)]))
+		}
+	case 0x7:
+		for j := uint32(0); j < words; j++ {
+			standInConfig[addr+BaseAddress(j)] = IPbusWord(word[2+j])
+		}
+	}
+	head := th &^ 0xf
+	if addr >= standInBusLimit {
+		head |= uint32(BusErrorOnRead)
+		data = nil
+	}
+	return append([]uint32{head}, data...), standInRequestSize(th)
+}
+
+func TestUDPClientDispatch(t *testing.T) {
+	mem := map[BaseAddress]IPbusWord{0x10: 0x11, 0x11: 0x22, 0x12: 0x33}
+	addr, stop := udpStandIn(t, mem)
+	defer stop()
+
+	c, err := DialUDP(UDPScheme + "://" + addr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+
+	cp := new(IPbusControlPacket)
+	cp.Append(NewReadRequest(0x10, 3))
+	cp.Append(NewWriteRequest(0x20, []IPbusWord{0x5, 0x6}))
+	cp.Append(NewRMWsumRequest(0x12, 0x1))
+	resps, err := c.Dispatch(cp)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	if len(resps) != 3 {
+		t.Fatalf("Expected 3 responses, generated %v\n", len(resps))
+	}
+	expected := []IPbusWord{0x11, 0x22, 0x33}
+	for i, v := range resps[0].Data() {
+		if v != expected[i] {
+			t.Errorf("Expected word %#x, generated %#x\n", expected[i], v)
+		}
+	}
+	if peek(mem, 0x20) != 0x5 || peek(mem, 0x21) != 0x6 {
+		t.Errorf("Expected memory 0x5 0x6, generated %#x %#x\n", peek(mem, 0x20), peek(mem, 0x21))
+	}
+	if d := resps[2].Data(); len(d) != 1 || d[0] != 0x33 || peek(mem, 0x12) != 0x34 {
+		t.Errorf("Expected RMWsum 0x33 -> 0x34, generated %#x -> %#x\n", d, peek(mem, 0x12))
+	}
+}
+
+func TestUDPClientInfoCode(t *testing.T) {
+	addr, stop := udpStandIn(t, map[BaseAddress]IPbusWord{})
+	defer stop()
+
+	c, err := Open(UDPScheme + "://" + addr)
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+
+	cp := new(IPbusControlPacket)
+	cp.Append(NewReadRequest(0x1, 1))
+	cp.Append(NewReadRequest(standInBusLimit, 2))
+	cp.Append(NewReadRequest(0x1, 1))
+	resps, err := c.Dispatch(cp)
+	ie, ok := err.(*InfoCodeError)
+	if !ok || ie.InfoCode != BusErrorOnRead {
+		t.Fatalf("Expected bus error on read, generated %v\n", err)
+	}
+	if len(resps) != 3 || len(resps[1].Data()) != 0 {
+		t.Errorf("Expected 3 responses without error payload, generated %v\n", resps)
+	}
+}
+
+func TestUDPClientTimeout(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer conn.Close()
+
+	c, err := DialUDP(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+	c.Timeout = 50 * time.Millisecond
+
+	cp := new(IPbusControlPacket)
+	_, err = c.Dispatch(cp)
+	if err != ErrTimeout {
+		t.Errorf("Expected %v, generated %v\n", ErrTimeout, err)
+	}
+}
+
+func TestUDPClientContext(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer conn.Close()
+
+	c, err := DialUDP(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error %v\n", err)
+	}
+	defer c.Close()
+	c.Timeout = 10 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err = c.DispatchContext(ctx, new(IPbusControlPacket))
+	if err != context.Canceled || time.Since(start) > time.Second {
+		t.Errorf("Expected %v, generated %v after %v\n", context.Canceled, err, time.Since(start))
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = c.StatusContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, generated %v\n", context.DeadlineExceeded, err)
+	}
+
+	// A cancelled context sends nothing
+	id := c.Session().TransactionID()
+	cp := new(IPbusControlPacket)
+	cp.Append(NewReadRequest(0x0, 1))
+	_, err = c.DispatchContext(ctx, cp)
+	if err != context.DeadlineExceeded || c.Session().TransactionID() != id {
+		t.Errorf("Expected %v without packet, generated %v\n", context.DeadlineExceeded, err)
+	}
+}